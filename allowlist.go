@@ -0,0 +1,156 @@
+package slimgfast
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The things App.SizePolicy can do with a request for a size that isn't
+// allowed.
+const (
+	// SIZE_POLICY_REJECT responds with a 400.
+	SIZE_POLICY_REJECT = "reject"
+	// SIZE_POLICY_SNAP serves the nearest allowed size instead.
+	SIZE_POLICY_SNAP = "snap"
+	// SIZE_POLICY_REDIRECT redirects to the URL for the nearest allowed size,
+	// so that clients and CDNs only ever cache the allowed sizes.
+	SIZE_POLICY_REDIRECT = "redirect"
+)
+
+// ALLOWED_SIZES_REFRESH is how often the sizes allowed by App.AllowTopSizes
+// are worked out again from the size counts.
+const ALLOWED_SIZES_REFRESH = 1 * time.Minute
+
+// topSizesCache caches the most requested sizes, for App.AllowTopSizes, so
+// they don't have to be ranked on every request.
+type topSizesCache struct {
+	mut       sync.Mutex
+	top       []Size
+	refreshed time.Time
+}
+
+// allowedSizes returns every size the App allows, or nil if there's no
+// allowlist yet.
+func (app *App) allowedSizes() []Size {
+	if app.AllowTopSizes == 0 {
+		return app.AllowedSizes
+	}
+	app.allowed.mut.Lock()
+	defer app.allowed.mut.Unlock()
+	if time.Since(app.allowed.refreshed) > ALLOWED_SIZES_REFRESH {
+		if top, err := app.topSizes(); err == nil {
+			app.allowed.top = top
+		}
+		// Otherwise keep using the last list we worked out
+		app.allowed.refreshed = time.Now()
+	}
+	sizes := make([]Size, 0, len(app.AllowedSizes)+len(app.allowed.top))
+	sizes = append(sizes, app.AllowedSizes...)
+	return append(sizes, app.allowed.top...)
+}
+
+// topSizes returns the AllowTopSizes most requested sizes, leaving out any
+// that haven't been requested at least AllowTopSizesMinCount times.
+func (app *App) topSizes() ([]Size, error) {
+	ranked, err := app.sizeCounter.GetRankedSizes()
+	if err != nil {
+		return nil, err
+	}
+	top := make([]Size, 0, app.AllowTopSizes)
+	for i := 0; i < len(ranked) && uint(i) < app.AllowTopSizes; i++ {
+		if ranked[i].Count < app.AllowTopSizesMinCount {
+			break
+		}
+		top = append(top, ranked[i].Size)
+	}
+	return top, nil
+}
+
+// enforceSizePolicy checks the request's size against the allowed sizes, and
+// applies the App's SizePolicy if it isn't one of them.  Requests being
+// snapped are changed in place.  It returns true if it has already responded
+// to the request.
+func (app *App) enforceSizePolicy(w http.ResponseWriter, r *http.Request, req *ImageRequest) bool {
+	if app.SizePolicy == "" {
+		return false
+	}
+	size, err := req.Size()
+	if err != nil {
+		// Requests for the original size are always allowed
+		return false
+	}
+	allowed := app.allowedSizes()
+	if len(allowed) == 0 {
+		// Until there's an allowlist, everything is allowed
+		return false
+	}
+	nearest, ok := nearestSize(*size, allowed)
+	if ok && nearest == *size {
+		return false
+	}
+	if !ok || app.SizePolicy != SIZE_POLICY_SNAP && app.SizePolicy != SIZE_POLICY_REDIRECT {
+		app.handleError(NewError(
+			ErrBadDimensions,
+			fmt.Errorf("%s is not an allowed size", size.Key()),
+		), w, r, req)
+		return true
+	}
+	if app.SizePolicy == SIZE_POLICY_REDIRECT {
+		redirectUrl := *r.URL
+		query := redirectUrl.Query()
+		query.Del("w")
+		query.Del("h")
+		if nearest.Width != 0 {
+			query.Set("w", strconv.FormatUint(uint64(nearest.Width), 10))
+		}
+		if nearest.Height != 0 {
+			query.Set("h", strconv.FormatUint(uint64(nearest.Height), 10))
+		}
+		if len(app.SigningKeys) > 0 {
+			// The request's own signature was good, so it's safe to sign
+			// the same image at an allowed size.
+			signQuery(app.SigningKeys[0], redirectUrl.EscapedPath(), query)
+		}
+		redirectUrl.RawQuery = query.Encode()
+		http.Redirect(w, r, redirectUrl.String(), http.StatusFound)
+		return true
+	}
+	req.Width = int(nearest.Width)
+	req.Height = int(nearest.Height)
+	return false
+}
+
+// nearestSize finds the allowed size closest to the requested one.  Only
+// sizes that give the same dimensions as the request are considered, so a
+// request for just a width only snaps to sizes with just a width.  The
+// smallest size at least as big as the request is preferred, so that images
+// aren't served smaller than asked for, and failing that the closest.
+func nearestSize(size Size, allowed []Size) (Size, bool) {
+	var best Size
+	bestCovers, found := false, false
+	bestDistance := uint(0)
+	for _, candidate := range allowed {
+		if (candidate.Width == 0) != (size.Width == 0) || (candidate.Height == 0) != (size.Height == 0) {
+			continue
+		}
+		covers := candidate.Width >= size.Width && candidate.Height >= size.Height
+		distance := absDiff(candidate.Width, size.Width) + absDiff(candidate.Height, size.Height)
+		better := !found ||
+			covers && !bestCovers ||
+			covers == bestCovers && distance < bestDistance
+		if better {
+			best, bestCovers, bestDistance, found = candidate, covers, distance, true
+		}
+	}
+	return best, found
+}
+
+func absDiff(a, b uint) uint {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
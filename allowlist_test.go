@@ -0,0 +1,136 @@
+package slimgfast
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNearestSize(t *testing.T) {
+	allowed := []Size{{100, 100}, {300, 200}, {640, 480}, {300, 0}, {0, 150}}
+	tests := []struct {
+		size     Size
+		expected Size
+		ok       bool
+	}{
+		{Size{300, 200}, Size{300, 200}, true},
+		// The smallest size that's at least as big wins...
+		{Size{290, 190}, Size{300, 200}, true},
+		{Size{301, 200}, Size{640, 480}, true},
+		// ...unless nothing is big enough.
+		{Size{2000, 2000}, Size{640, 480}, true},
+		{Size{50, 0}, Size{300, 0}, true},
+		{Size{0, 500}, Size{0, 150}, true},
+	}
+	for _, test := range tests {
+		nearest, ok := nearestSize(test.size, allowed)
+		if ok != test.ok || nearest != test.expected {
+			t.Error("Expected", test.size, "to snap to", test.expected, "got:", nearest, ok)
+		}
+	}
+	if _, ok := nearestSize(Size{0, 10}, []Size{{10, 10}}); ok {
+		t.Error("Expected a height-only request not to snap to a full size")
+	}
+}
+
+func TestEnforceSizePolicy(t *testing.T) {
+	app := &App{AllowedSizes: []Size{{100, 100}, {300, 200}}}
+	url := "/a.jpg?w=250&h=150&fit=crop"
+
+	// No policy, no allowlist
+	req, _ := ImageRequestFromURLString(url)
+	w := httptest.NewRecorder()
+	if app.enforceSizePolicy(w, httptest.NewRequest("GET", url, nil), req) || req.Width != 250 {
+		t.Error("Expected every size to be allowed without a policy")
+	}
+
+	app.SizePolicy = SIZE_POLICY_REJECT
+	w = httptest.NewRecorder()
+	if !app.enforceSizePolicy(w, httptest.NewRequest("GET", url, nil), req) || w.Code != http.StatusBadRequest {
+		t.Error("Expected a 400 for a size that isn't allowed, got:", w.Code)
+	}
+	allowedReq, _ := ImageRequestFromURLString("/a.jpg?w=100&h=100")
+	if app.enforceSizePolicy(httptest.NewRecorder(), httptest.NewRequest("GET", "/a.jpg?w=100&h=100", nil), allowedReq) {
+		t.Error("Expected an allowed size to be served")
+	}
+
+	app.SizePolicy = SIZE_POLICY_SNAP
+	if app.enforceSizePolicy(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil), req) {
+		t.Error("Expected a snapped size to be served")
+	}
+	if req.Width != 300 || req.Height != 200 {
+		t.Error("Expected the request to snap to 300x200, got:", req.Width, req.Height)
+	}
+
+	app.SizePolicy = SIZE_POLICY_REDIRECT
+	req, _ = ImageRequestFromURLString(url)
+	w = httptest.NewRecorder()
+	if !app.enforceSizePolicy(w, httptest.NewRequest("GET", url, nil), req) || w.Code != http.StatusFound {
+		t.Error("Expected a redirect, got:", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "/a.jpg?fit=crop&h=200&w=300" {
+		t.Error("Expected a redirect to the nearest size, got:", location)
+	}
+}
+
+func TestAllowTopSizes(t *testing.T) {
+	app := &App{
+		SizePolicy:    SIZE_POLICY_REJECT,
+		AllowedSizes:  []Size{{100, 100}},
+		AllowTopSizes: 1,
+		sizeCounter:   newTestSizeCounter(map[string]uint{"640x480": 10, "20x20": 1}),
+	}
+	allowed := app.allowedSizes()
+	if len(allowed) != 2 || allowed[0] != (Size{100, 100}) || allowed[1] != (Size{640, 480}) {
+		t.Error("Expected the static and most requested sizes, got:", allowed)
+	}
+}
+
+func TestServeHTTPAllowsNewlyPopularSizes(t *testing.T) {
+	app := getTestApp(t)
+	counter := newTestSizeCounter(map[string]uint{})
+	oldCounter := app.sizeCounter
+	app.sizeCounter = counter
+	app.SizePolicy = SIZE_POLICY_REJECT
+	app.AllowedSizes = []Size{{100, 50}}
+	app.AllowTopSizes = 1
+	app.AllowTopSizesMinCount = 3
+	defer func() {
+		app.sizeCounter = oldCounter
+		app.SizePolicy = ""
+		app.AllowedSizes = nil
+		app.AllowTopSizes = 0
+		app.AllowTopSizesMinCount = DEFAULT_ALLOW_TOP_SIZES_MIN_COUNT
+		app.allowed = topSizesCache{}
+	}()
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		// Work the allowlist out again on the next request
+		app.allowed.mut.Lock()
+		app.allowed.refreshed = time.Time{}
+		app.allowed.mut.Unlock()
+		return w.Code
+	}
+
+	// Sizes that aren't allowed are still counted...
+	for i := 0; i < 2; i++ {
+		if code := get("/wide.png?w=60&h=30"); code != http.StatusBadRequest {
+			t.Fatal("Expected 60x30 to be rejected before it's popular, got:", code)
+		}
+	}
+	// ...so once a size is popular enough, it's allowed, starting with the
+	// request that made it so
+	if code := get("/wide.png?w=60&h=30"); code != http.StatusOK {
+		t.Error("Expected the newly popular 60x30 to be allowed, got:", code)
+	}
+	// But a size that's only been asked for a couple of times isn't
+	get("/wide.png?w=70&h=35")
+	if code := get("/wide.png?w=70&h=35"); code != http.StatusBadRequest {
+		t.Error("Expected 70x35 to be rejected below the minimum count, got:", code)
+	}
+	if code := get("/wide.png?w=5000&h=10"); code != http.StatusBadRequest || counter.counts["5000x10"] != 0 {
+		t.Error("Expected sizes over the maximum not to be counted, got:", code, counter.counts)
+	}
+}
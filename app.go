@@ -5,37 +5,187 @@
 package slimgfast
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/golang/groupcache"
+	"image/color"
+	"image/jpeg"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 const RESIZED_IMAGE_SOURCE_NAME string = "slimgfast_resized_image_source"
 
+// DEFAULT_REQUEST_TIMEOUT is how long a request has to fetch and resize its
+// image by default.
+const DEFAULT_REQUEST_TIMEOUT = 30 * time.Second
+
+// DEFAULT_MAX_SOURCE_PIXELS is the most pixels a source image can have before
+// the App refuses to decode it.
+const DEFAULT_MAX_SOURCE_PIXELS = 50 * 1000 * 1000
+
+// DEFAULT_RETRY_AFTER is how long clients are told to wait before trying again
+// when the App is too busy to serve them.
+const DEFAULT_RETRY_AFTER = 1 * time.Second
+
+// DEFAULT_SOURCE_CHECK_INTERVAL is how often, by default, the App checks
+// whether a source image has changed, for fetchers that implement
+// StatFetcher.
+const DEFAULT_SOURCE_CHECK_INTERVAL = 5 * time.Second
+
+// DEFAULT_ALLOW_TOP_SIZES_MIN_COUNT is how many times, by default, a size has
+// to have been requested before App.AllowTopSizes allows it.
+const DEFAULT_ALLOW_TOP_SIZES_MIN_COUNT = 10
+
+// Defaults for the App's output quality settings.
+const (
+	DEFAULT_QUALITY     = jpeg.DefaultQuality
+	DEFAULT_MIN_QUALITY = 1
+	DEFAULT_MAX_QUALITY = 100
+)
+
 // App ties together the fetcher, the transformers, handles the lifecycle of an
 // image request, and does the actual HTTP serving.
 type App struct {
-	MaxWidth    int
-	MaxHeight   int
+	MaxWidth  int
+	MaxHeight int
+	// DefaultQuality is the output quality used when the request doesn't ask
+	// for one with the "q" query parameter.
+	DefaultQuality int
+	// MinQuality and MaxQuality bound the output quality that can be
+	// requested with the "q" query parameter.
+	MinQuality int
+	MaxQuality int
+	// CacheMaxAge is the max-age sent in the Cache-Control header of image
+	// responses.  Zero or less sends "no-cache" instead.
+	CacheMaxAge time.Duration
+	// VaryHeaders are sent in the Vary header of image responses.  Images
+	// are cached by their URL alone, so this is only for headers that
+	// something in front of the App varies on, like a CDN that picks the URL
+	// by the Accept header.  Headers forwarded to the origin by a
+	// ProxyFetcher don't change the image, so they needn't be listed.
+	VaryHeaders []string
+	// ErrorImages turns on serving placeholder images, in the requested size
+	// and format, instead of plain text error messages.  The error's HTTP
+	// status code is kept.
+	ErrorImages bool
+	// ErrorImageColor and ErrorImageTextColor are the background and text
+	// colors of the placeholder images.  If nil, a light gray background with
+	// darker gray text is used.
+	ErrorImageColor     color.Color
+	ErrorImageTextColor color.Color
+	// ErrorImageText is the text written on the placeholder images.  If
+	// empty, the HTTP status code is written.
+	ErrorImageText string
+	// FallbackImagePath, if set, is the path of an image (as understood by
+	// the Fetcher) that is resized and served in place of images that can't
+	// be found.
+	FallbackImagePath string
+	// RequestTimeout is how long a request has to fetch and resize its image
+	// before giving up with a 504.  Zero means no limit, other than the
+	// client going away.
+	RequestTimeout time.Duration
+	// Debug sends the full text of errors to the client, rather than just
+	// the kind of error that happened.
+	Debug bool
+	// MaxConcurrentFetches limits how many source images are fetched at
+	// once.  Fetches happen outside of the worker pool, so a slow origin
+	// can't tie up the workers.  It takes effect when the App is started.
+	MaxConcurrentFetches int
+	// MaxQueue is the most images that can be waiting for a worker at once,
+	// and QueueTimeout is the longest one will wait.  Past either, requests
+	// are shed with a 503 rather than piling up.  Zero means no limit.  They
+	// take effect when the App is started.
+	MaxQueue     int
+	QueueTimeout time.Duration
+	// BackgroundShare is the minimum share of the workers that background
+	// jobs, like prewarming, are guaranteed when interactive requests are
+	// also waiting: one job in every BackgroundShare.  It takes effect when
+	// the App is started.
+	BackgroundShare int
+	// PrewarmTopSizes is how many of the most requested sizes Prewarm
+	// generates for each source image.
+	PrewarmTopSizes uint
+	// SizeHalfLife turns on time decay of the size counts used to rank the
+	// most requested sizes, so that a request counts half as much after
+	// each SizeHalfLife.  Zero ranks sizes by their raw counts.  It takes
+	// effect when the App is started.
+	SizeHalfLife time.Duration
+	// PeerPullInterval is how often size counts are pulled from the peers
+	// set with SetPeers.  It takes effect when the App is started.
+	PeerPullInterval time.Duration
+	// SizePolicy turns on the size allowlist, to stop clients from filling
+	// the cache with every size under the sun.  It's what happens to requests
+	// for sizes that aren't allowed: one of SIZE_POLICY_REJECT,
+	// SIZE_POLICY_SNAP or SIZE_POLICY_REDIRECT.  Empty allows every size.
+	SizePolicy string
+	// AllowedSizes are the sizes that are allowed when SizePolicy is set.
+	AllowedSizes []Size
+	// AllowTopSizes also allows the given number of the most requested
+	// sizes.  While there are no allowed sizes at all, every size is allowed.
+	AllowTopSizes uint
+	// AllowTopSizesMinCount is how many times a size has to have been
+	// requested before AllowTopSizes allows it, so that a handful of
+	// requests can't add a size to the allowlist.
+	AllowTopSizesMinCount float64
+	allowed               topSizesCache
+	// SigningKeys turns on signed URLs: only URLs signed with one of these
+	// keys (see SignURL) are served, and anything else gets a 403.  Having
+	// more than one key allows keys to be rotated.  New signatures, like
+	// those for size policy redirects, use the first key.
+	SigningKeys [][]byte
+	// MaxSourcePixels is the most pixels (width times height) a source image
+	// can have before the App refuses to decode it with a 422.  Zero means no
+	// limit.  It takes effect when the App is started.
+	MaxSourcePixels int64
+	// SourceCheckInterval is how often the App checks whether a source image
+	// has changed, if the Fetcher implements StatFetcher.  Images resized
+	// from a source image that has since changed are resized again.  Zero
+	// turns the checks off.  It takes effect when the App is started.
+	SourceCheckInterval time.Duration
+	// RetryAfter is sent in the Retry-After header of 503 responses.
+	RetryAfter  time.Duration
+	validators  *validatorCache
+	loads       sharedLoads
+	imageSource *ImageSource
 	sizeCounter *SizeCounter
 	cache       *groupcache.Group
 	workerGroup *WorkerGroup
 }
 
-func getCacheGetter(imageSource *ImageSource, workerGroup *WorkerGroup) groupcache.Getter {
+func getCacheGetter(imageSource *ImageSource, workerGroup *WorkerGroup, loads *sharedLoads) groupcache.Getter {
 	return groupcache.GetterFunc(
 		func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
 			req, err := ImageRequestFromCacheKey(key)
 			if err != nil {
 				return err
 			}
-			resizedData, err := workerGroup.Resize(imageSource, req)
+			// Fetch the source image before handing it to the worker group,
+			// so that a slow origin ties up a fetch slot rather than a worker.
+			reqCtx := contextFromGroupcache(ctx)
+			if PriorityFromContext(reqCtx) == PRIORITY_BACKGROUND {
+				// Interactive callers who join this load shouldn't have to
+				// wait at background priority.
+				promoted, done := loads.startBackground(key)
+				defer done()
+				reqCtx = withPromotion(reqCtx, promoted)
+			}
+			data, info, err := imageSource.GetImageData(reqCtx, req)
+			if err != nil {
+				return err
+			}
+			resizedData, err := workerGroup.Resize(reqCtx, data, req)
 			if err != nil {
 				return err
 			}
-			dest.SetBytes(resizedData)
-			return nil
+			encoded, err := encodeImageData(info, resizedData)
+			if err != nil {
+				return err
+			}
+			return dest.SetBytes(encoded)
 		})
 }
 
@@ -52,6 +202,8 @@ func NewApp(
 	workerGroup := &WorkerGroup{
 		NumWorkers:   numWorkers,
 		Transformers: transformers,
+		MaxWidth:     maxWidth,
+		MaxHeight:    maxHeight,
 	}
 	// Create a counter to track image size requests
 	sizeCounter, err := NewSizeCounter(counterFilename)
@@ -60,16 +212,30 @@ func NewApp(
 	}
 
 	app := &App{
-		MaxWidth:    maxWidth,
-		MaxHeight:   maxHeight,
-		sizeCounter: sizeCounter,
-		workerGroup: workerGroup,
+		MaxWidth:              maxWidth,
+		MaxHeight:             maxHeight,
+		DefaultQuality:        DEFAULT_QUALITY,
+		MinQuality:            DEFAULT_MIN_QUALITY,
+		MaxQuality:            DEFAULT_MAX_QUALITY,
+		CacheMaxAge:           DEFAULT_CACHE_MAX_AGE,
+		RequestTimeout:        DEFAULT_REQUEST_TIMEOUT,
+		MaxConcurrentFetches:  DEFAULT_MAX_CONCURRENT_FETCHES,
+		BackgroundShare:       DEFAULT_BACKGROUND_SHARE,
+		PrewarmTopSizes:       DEFAULT_PREWARM_TOP_SIZES,
+		AllowTopSizesMinCount: DEFAULT_ALLOW_TOP_SIZES_MIN_COUNT,
+		PeerPullInterval:      DEFAULT_PEER_PULL_INTERVAL,
+		MaxSourcePixels:       DEFAULT_MAX_SOURCE_PIXELS,
+		RetryAfter:            DEFAULT_RETRY_AFTER,
+		SourceCheckInterval:   DEFAULT_SOURCE_CHECK_INTERVAL,
+		validators:            newValidatorCache(DEFAULT_VALIDATOR_CACHE_ENTRIES),
+		sizeCounter:           sizeCounter,
+		workerGroup:           workerGroup,
 	}
-	imageSource := NewImageSource(fetcher)
+	app.imageSource = NewImageSource(fetcher)
 	app.cache = groupcache.NewGroup(
 		RESIZED_IMAGE_SOURCE_NAME,
 		cacheMegabytes<<20,
-		getCacheGetter(imageSource, workerGroup),
+		getCacheGetter(app.imageSource, workerGroup, &app.loads),
 	)
 	return app, err
 }
@@ -77,50 +243,174 @@ func NewApp(
 // ServeHTTP is responsible for actually kicking off the image transformations
 // and serving the image back to the user who requested it.
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		app.handleError(ErrMethodNotAllowed, w, r, nil)
+		return
+	}
+
+	// Check the signature before doing anything else, so that unsigned
+	// requests can't get at the cache, or skew the size counts.
+	if err := app.verifySignature(r); err != nil {
+		app.handleError(err, w, r, nil)
+		return
+	}
+
 	req, err := ImageRequestFromURLString(r.URL.String())
 	if err != nil {
-		handleError(http.StatusNotFound, err.Error(), w, r)
+		app.handleError(NewError(ErrBadRequest, err), w, r, nil)
 		return
 	}
 
+	if req.Width != 0 && req.Width > app.MaxWidth {
+		app.handleError(ErrBadDimensions, w, r, req)
+		return
+	}
+	if req.Height != 0 && req.Height > app.MaxHeight {
+		app.handleError(ErrBadDimensions, w, r, req)
+		return
+	}
+
+	// Sizes are counted before the size policy is applied, so that sizes
+	// that become popular can make their way into the allowlist.
 	if size, err := req.Size(); err != nil {
 		// We don't care to capture stats about requests with no size
 	} else {
 		app.sizeCounter.CountSize(size)
 	}
 
-	if req.Width != 0 && req.Width > app.MaxWidth {
-		handleBadDimensions(w, r)
+	if app.enforceSizePolicy(w, r, req) {
 		return
 	}
-	if req.Height != 0 && req.Height > app.MaxHeight {
-		handleBadDimensions(w, r)
+
+	req.Quality = app.requestQuality(req)
+
+	ctx := WithRequestHeader(r.Context(), r.Header)
+	if app.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.RequestTimeout)
+		defer cancel()
+	}
+
+	// The source image's version is part of the cache key, so it has to be
+	// known before anything is looked up in the cache.
+	if err = app.setSourceVersion(ctx, req); err != nil {
+		app.handleError(err, w, r, req)
 		return
 	}
 
-	var resizedData []byte
-	imgSink := groupcache.AllocatingByteSliceSink(&resizedData)
 	cacheKey, err := req.CacheKey()
 	if err != nil {
-		handleError(http.StatusNotFound, err.Error(), w, r)
+		app.handleError(err, w, r, req)
+		return
+	}
+
+	// If we've served this image before, we may be able to tell the client
+	// that its copy is still good without getting the image at all.
+	if v, ok := app.validators.Get(cacheKey); ok && notModified(r, v) {
+		app.writeNotModified(w, v)
 		return
 	}
-	err = app.cache.Get(nil, cacheKey, imgSink)
+
+	resizedData, info, err := app.getImage(ctx, req)
 	if err != nil {
-		handleError(http.StatusNotFound, err.Error(), w, r)
+		app.handleError(err, w, r, req)
 		return
 	}
 
+	v := newValidators(cacheKey, &ResizedImage{Data: resizedData, SourceInfo: info})
+	app.validators.Add(cacheKey, v)
+	if notModified(r, v) {
+		app.writeNotModified(w, v)
+		return
+	}
+	app.writeImage(w, r, req, resizedData, v)
+}
+
+// setSourceVersion fills in the version of the source image the request asks
+// for, so that it's resized again if the source image has changed.
+func (app *App) setSourceVersion(ctx context.Context, req *ImageRequest) error {
+	version, err := app.imageSource.SourceVersion(ctx, req)
+	if err != nil {
+		return err
+	}
+	req.SourceVersion = version
+	return nil
+}
+
+// getImage gets the resized image for a request out of the cache, resizing it
+// if need be.
+func (app *App) getImage(ctx context.Context, req *ImageRequest) ([]byte, *SourceInfo, error) {
+	cacheKey, err := req.CacheKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if PriorityFromContext(ctx) == PRIORITY_INTERACTIVE {
+		// Promote any background load of the image that we end up sharing
+		defer app.loads.wait(cacheKey)()
+	}
+	var encoded []byte
+	imgSink := groupcache.AllocatingByteSliceSink(&encoded)
+	if err = getShared(ctx, app.cache, cacheKey, imgSink); err != nil {
+		return nil, nil, err
+	}
+	return decodeImageData(encoded)
+}
+
+// writeImage writes out a successful image response.  All of the headers are
+// set before the status is written, and HEAD requests get the same headers as
+// a GET but no body.
+func (app *App) writeImage(w http.ResponseWriter, r *http.Request, req *ImageRequest, data []byte, v *validators) {
+	w.Header().Set("Content-Type", ContentTypeFor(req, data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	app.setCachingHeaders(w, v)
 	w.WriteHeader(http.StatusOK)
-	w.Header().Add("Content-Type", "image/jpeg")
-	w.Write(resizedData)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+// writeNotModified tells the client that its cached copy of the image is
+// still good.
+func (app *App) writeNotModified(w http.ResponseWriter, v *validators) {
+	app.setCachingHeaders(w, v)
+	w.WriteHeader(http.StatusNotModified)
 }
 
 // Start starts the application worker group and size counter goroutines.
 func (app *App) Start() {
+	app.imageSource.SetMaxConcurrentFetches(app.MaxConcurrentFetches)
+	app.imageSource.SetStatInterval(app.SourceCheckInterval)
+	app.workerGroup.MaxQueue = app.MaxQueue
+	app.workerGroup.QueueTimeout = app.QueueTimeout
+	app.workerGroup.BackgroundShare = app.BackgroundShare
+	app.workerGroup.MaxPixels = app.MaxSourcePixels
 	app.workerGroup.Start()
+	app.sizeCounter.SetHalfLife(app.SizeHalfLife)
 	// Should we un-hardcode this? Does anyone care?
 	app.sizeCounter.Start(1 * time.Second)
+	if app.PeerPullInterval > 0 {
+		app.sizeCounter.StartPullingPeers(app.PeerPullInterval)
+	}
+}
+
+// SetPeers tells the App about the other nodes in the cluster, so that the
+// most requested sizes are ranked cluster-wide.  It takes the same URLs as
+// groupcache's HTTPPool.Set, with self being this node's own URL.  Each node
+// should serve SizeCounter() on SIZE_STATS_PATH at its URL.
+func (app *App) SetPeers(self string, peers ...string) {
+	app.sizeCounter.SetPeers(self, peers...)
+}
+
+// SizeCounter returns the App's SizeCounter.  It's an http.Handler for the
+// App's own size counts, to be served on SIZE_STATS_PATH.
+func (app *App) SizeCounter() *SizeCounter {
+	return app.sizeCounter
+}
+
+// WorkerStats returns a snapshot of what the App's workers are up to.
+func (app *App) WorkerStats() WorkerGroupStats {
+	return app.workerGroup.Stats()
 }
 
 // Close signals to the worker group and size counter goroutines to exit.
@@ -129,18 +419,66 @@ func (app *App) Close() {
 	app.sizeCounter.Close()
 }
 
+// clampQuality fills in the default quality for requests which didn't ask for
+// one, and keeps the quality within the App's configured range.
+func (app *App) clampQuality(quality int) int {
+	if quality == 0 {
+		quality = app.DefaultQuality
+	}
+	if app.MinQuality != 0 && quality < app.MinQuality {
+		quality = app.MinQuality
+	}
+	if app.MaxQuality != 0 && quality > app.MaxQuality {
+		quality = app.MaxQuality
+	}
+	return quality
+}
+
+// requestQuality returns the quality to encode the request's image at.  PNG
+// and GIF are lossless, so their quality is always zero, and asking for a
+// different quality doesn't make another cache entry of the same image.
+func (app *App) requestQuality(req *ImageRequest) int {
+	if req.Format == FORMAT_PNG || req.Format == FORMAT_GIF {
+		return 0
+	}
+	return app.clampQuality(req.Quality)
+}
+
 // handleError handles any errors that happen in the HTTP request/response
-// cycle.
-func handleError(status int, content string, w http.ResponseWriter, r *http.Request) {
-	// TODO: Generate an error image in the correct dimensions?
+// cycle, responding with the status code that matches the kind of error.  If
+// the App is set up for it, the client gets an image back rather than a plain
+// text error, so that <img> tags don't show up broken.
+func (app *App) handleError(err error, w http.ResponseWriter, r *http.Request, req *ImageRequest) {
+	status := StatusForError(err)
+	if r.Context().Err() != nil {
+		// The client went away, so there's nobody to respond to.
+		return
+	}
+	if status == http.StatusServiceUnavailable && app.RetryAfter > 0 {
+		seconds := int64((app.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	if status >= http.StatusInternalServerError && !errors.Is(err, ErrOverloaded) {
+		log.Println("Error serving image", r.URL, err)
+	}
+	if status == http.StatusNotFound && app.FallbackImagePath != "" && req != nil {
+		fallbackErr := app.writeFallbackImage(status, w, r, req)
+		if fallbackErr == nil {
+			return
+		}
+		log.Println("Error serving fallback image", fallbackErr)
+	}
+	if app.ErrorImages && status != http.StatusMethodNotAllowed {
+		renderErr := app.writeErrorImage(status, w, r, req)
+		if renderErr == nil {
+			return
+		}
+		log.Println("Error rendering error image", renderErr)
+	}
+	content := publicErrorMessage(err)
+	if app.Debug {
+		content = err.Error()
+	}
 	w.WriteHeader(status)
 	fmt.Fprint(w, content)
 }
-
-// handleBadDimensions handles any errors that happen because the user requests
-// dimensions that are too large or invalid.
-func handleBadDimensions(w http.ResponseWriter, r *http.Request) {
-	// TODO: Generate an error image in the correct dimensions?
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprint(w, "Bad image dimensions requested.")
-}
@@ -0,0 +1,400 @@
+package slimgfast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/golang/groupcache"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClampQuality(t *testing.T) {
+	app := &App{DefaultQuality: 80, MinQuality: 30, MaxQuality: 90}
+	cases := map[int]int{0: 80, 10: 30, 30: 30, 60: 60, 90: 90, 100: 90}
+	for requested, expected := range cases {
+		if actual := app.clampQuality(requested); actual != expected {
+			t.Error("Expected quality", requested, "to clamp to", expected, "got", actual)
+		}
+	}
+}
+
+func TestRequestQualityLossless(t *testing.T) {
+	app := &App{DefaultQuality: 80}
+	keys := map[string]bool{}
+	for _, rawUrl := range []string{"/a.jpg?fm=png&q=10", "/a.jpg?fm=png&q=90", "/a.jpg?fm=png"} {
+		req, err := ImageRequestFromURLString(rawUrl)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Quality = app.requestQuality(req)
+		key, err := req.CacheKey()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		keys[key] = true
+	}
+	if len(keys) != 1 {
+		t.Error("Expected PNG requests to share a cache key whatever their quality, got:", keys)
+	}
+	req, _ := ImageRequestFromURLString("/a.jpg?fm=jpg&q=10")
+	if quality := app.requestQuality(req); quality != 10 {
+		t.Error("Expected JPEG requests to keep their quality, got:", quality)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modTime := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	v := &validators{ETag: `"abc"`, LastModified: modTime}
+	cases := []struct {
+		header   string
+		value    string
+		expected bool
+	}{
+		{"If-None-Match", `"abc"`, true},
+		{"If-None-Match", `"xyz", "abc"`, true},
+		{"If-None-Match", `W/"abc"`, true},
+		{"If-None-Match", `*`, true},
+		{"If-None-Match", `"xyz"`, false},
+		{"If-Modified-Since", modTime.Format(http.TimeFormat), true},
+		{"If-Modified-Since", modTime.Add(time.Hour).Format(http.TimeFormat), true},
+		{"If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat), false},
+		{"If-Modified-Since", "garbage", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/a.jpg", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		if actual := notModified(r, v); actual != c.expected {
+			t.Error("Expected", c.header, c.value, "to give", c.expected, "got", actual)
+		}
+	}
+}
+
+func TestValidatorsChangeWithContent(t *testing.T) {
+	a := newValidators("key", &ResizedImage{Data: []byte("one")})
+	b := newValidators("key", &ResizedImage{Data: []byte("two")})
+	c := newValidators("other", &ResizedImage{Data: []byte("one")})
+	if a.ETag == b.ETag || a.ETag == c.ETag {
+		t.Error("Expected ETags to differ by content and cache key")
+	}
+	if a.ETag != newValidators("key", &ResizedImage{Data: []byte("one")}).ETag {
+		t.Error("Expected ETags to be stable")
+	}
+}
+
+// testFetcher serves images out of a map, keyed by URL path.
+type testFetcher struct {
+	images  map[string][]byte
+	modTime time.Time
+}
+
+func (f *testFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
+	_, err := f.FetchInfo(urlPath, dest)
+	return err
+}
+
+func (f *testFetcher) FetchInfo(urlPath string, dest groupcache.Sink) (*SourceInfo, error) {
+	data, ok := f.images[urlPath]
+	if !ok {
+		return nil, NewError(ErrNotFound, errors.New("No such image: "+urlPath))
+	}
+	dest.SetBytes(data)
+	return &SourceInfo{ModTime: f.modTime}, nil
+}
+
+var testApp *App
+var testAppOnce sync.Once
+
+// getTestApp returns an App serving a few test images.  groupcache groups
+// can only be registered once per process, so every test shares one App.
+func getTestApp(t *testing.T) *App {
+	testAppOnce.Do(func() {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+			t.Fatal(err.Error())
+		}
+		fetcher := &testFetcher{
+			images:  map[string][]byte{"/wide.png": buf.Bytes()},
+			modTime: time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC),
+		}
+		app, err := NewApp(
+			fetcher,
+			[]Transformer{&TransformerResize{}},
+			filepath.Join(os.TempDir(), "slimgfast_test_sizes.json"),
+			2,
+			16,
+			1000,
+			1000,
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		app.Start()
+		testApp = app
+	})
+	if testApp == nil {
+		t.Fatal("Could not create the test app")
+	}
+	return testApp
+}
+
+func TestServeHTTPHeaders(t *testing.T) {
+	app := getTestApp(t)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/wide.png?w=100", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected a 200, got:", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Error("Expected Content-Type image/png, got:", contentType)
+	}
+	if contentLength := w.Header().Get("Content-Length"); contentLength != strconv.Itoa(w.Body.Len()) {
+		t.Error("Expected Content-Length", w.Body.Len(), "got:", contentLength)
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Error("Expected an ETag")
+	}
+	if lastModified := w.Header().Get("Last-Modified"); lastModified != "Sun, 01 Jun 2014 12:00:00 GMT" {
+		t.Error("Expected the fetcher's Last-Modified, got:", lastModified)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); !strings.Contains(cacheControl, "max-age=") {
+		t.Error("Expected a Cache-Control max-age, got:", cacheControl)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+		t.Error("Expected a 100x50 image, got:", img.Bounds())
+	}
+}
+
+func TestServeHTTPVary(t *testing.T) {
+	app := getTestApp(t)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/wide.png?w=90", nil))
+	if vary := w.Header().Get("Vary"); vary != "" {
+		t.Error("Expected no Vary header, got:", vary)
+	}
+
+	app.VaryHeaders = []string{"Accept", "X-Device"}
+	defer func() { app.VaryHeaders = nil }()
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/wide.png?w=90", nil))
+	if vary := w.Header().Get("Vary"); vary != "Accept, X-Device" {
+		t.Error("Expected the configured headers in Vary, got:", vary)
+	}
+	r := httptest.NewRequest("GET", "/wide.png?w=90", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Header().Get("Vary") != "Accept, X-Device" {
+		t.Error("Expected a 304 with the same Vary header, got:", w.Code, w.Header())
+	}
+}
+
+func TestServeHTTPHead(t *testing.T) {
+	app := getTestApp(t)
+	get := httptest.NewRecorder()
+	app.ServeHTTP(get, httptest.NewRequest("GET", "/wide.png?w=50", nil))
+	head := httptest.NewRecorder()
+	app.ServeHTTP(head, httptest.NewRequest("HEAD", "/wide.png?w=50", nil))
+	if head.Code != http.StatusOK {
+		t.Fatal("Expected a 200, got:", head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Error("Expected no body for a HEAD request, got", head.Body.Len(), "bytes")
+	}
+	for _, header := range []string{"Content-Type", "Content-Length", "ETag"} {
+		if head.Header().Get(header) != get.Header().Get(header) {
+			t.Error("Expected HEAD and GET to have the same", header)
+		}
+	}
+}
+
+func TestServeHTTPMethodNotAllowed(t *testing.T) {
+	app := getTestApp(t)
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest(method, "/wide.png?w=50", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Error("Expected a 405 for", method, "got:", w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+			t.Error("Expected an Allow header, got:", allow)
+		}
+	}
+}
+
+func TestServeHTTPNotModified(t *testing.T) {
+	app := getTestApp(t)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/wide.png?w=60", nil))
+	etag := w.Header().Get("ETag")
+
+	r := httptest.NewRequest("GET", "/wide.png?w=60", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Error("Expected a 304 for a matching ETag, got:", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Error("Expected no body for a 304")
+	}
+
+	r = httptest.NewRequest("GET", "/wide.png?w=60", nil)
+	r.Header.Set("If-Modified-Since", "Mon, 02 Jun 2014 12:00:00 GMT")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Error("Expected a 304 for a later If-Modified-Since, got:", w.Code)
+	}
+}
+
+func TestServeHTTPErrorImage(t *testing.T) {
+	app := getTestApp(t)
+	app.ErrorImages = true
+	defer func() { app.ErrorImages = false }()
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/missing.png?w=40&h=30", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected the error image to keep the 404 status, got:", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Fatal("Expected a png error image, got:", contentType)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 30 {
+		t.Error("Expected a 40x30 error image, got:", img.Bounds())
+	}
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/missing.png?w=4000&fm=gif", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected the error image to keep the 400 status, got:", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "image/gif" {
+		t.Error("Expected a gif error image, got:", contentType)
+	}
+}
+
+func TestServeHTTPFallbackImage(t *testing.T) {
+	app := getTestApp(t)
+	app.FallbackImagePath = "/wide.png"
+	defer func() { app.FallbackImagePath = "" }()
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/missing.jpg?w=100", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected the fallback image to keep the 404 status, got:", w.Code)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+		t.Error("Expected the fallback image resized to 100x50, got:", img.Bounds())
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	cause := errors.New("secret internal details")
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{ErrBadDimensions, http.StatusBadRequest},
+		{NewError(ErrBadRequest, cause), http.StatusBadRequest},
+		{NewError(ErrNotFound, cause), http.StatusNotFound},
+		{NewError(ErrForbidden, cause), http.StatusForbidden},
+		{NewError(ErrUpstreamUnavailable, cause), http.StatusBadGateway},
+		{NewError(ErrTimeout, cause), http.StatusGatewayTimeout},
+		{NewError(ErrUnsupportedImage, cause), http.StatusUnsupportedMediaType},
+		{cause, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if status := StatusForError(c.err); status != c.status {
+			t.Error("Expected", c.err, "to be a", c.status, "got:", status)
+		}
+		if c.err != cause && !errors.Is(c.err, cause) && c.err != ErrBadDimensions {
+			t.Error("Expected", c.err, "to wrap its cause")
+		}
+	}
+}
+
+func TestServeHTTPErrorText(t *testing.T) {
+	app := getTestApp(t)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/missing.jpg", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected a 404, got:", w.Code)
+	}
+	if body := w.Body.String(); body != ErrNotFound.Error() {
+		t.Error("Expected only the kind of error to be shown, got:", body)
+	}
+
+	app.Debug = true
+	defer func() { app.Debug = false }()
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/missing.jpg", nil))
+	if body := w.Body.String(); !strings.Contains(body, "No such image") {
+		t.Error("Expected the full error in debug mode, got:", body)
+	}
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/wide.png?fit=squash", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected a 400 for a bad request, got:", w.Code)
+	}
+}
+
+func TestHandleErrorRetryAfter(t *testing.T) {
+	app := &App{RetryAfter: 1500 * time.Millisecond}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/wide.png?w=10", nil)
+	app.handleError(NewError(ErrOverloaded, errors.New("The job queue is full")), w, r, nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected a 503, got:", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Error("Expected a Retry-After of 2 seconds, got:", retryAfter)
+	}
+}
+
+func TestHandleErrorCancelled(t *testing.T) {
+	app := &App{RetryAfter: time.Second}
+
+	// Another client called off a load this one was sharing
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/wide.png?w=10", nil)
+	app.handleError(context.Canceled, w, r, nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Error("Expected a 503 with a Retry-After, got:", w.Code, w.Header())
+	}
+
+	// This client went away itself
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	app.handleError(context.Canceled, w, r.WithContext(ctx), nil)
+	if w.Body.Len() != 0 || w.Header().Get("Retry-After") != "" {
+		t.Error("Expected nothing to be written for a client that's gone, got:", w.Body.String())
+	}
+}
@@ -0,0 +1,114 @@
+package slimgfast
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/groupcache/lru"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_CACHE_MAX_AGE is how long clients and CDNs are told they can cache
+// resized images for.
+const DEFAULT_CACHE_MAX_AGE = 7 * 24 * time.Hour
+
+// DEFAULT_VALIDATOR_CACHE_ENTRIES is how many cache keys the App remembers
+// the ETag and Last-Modified of, so that it can answer conditional requests
+// without fetching or resizing anything.
+const DEFAULT_VALIDATOR_CACHE_ENTRIES = 10000
+
+// validators are the values that a client can use to make a conditional
+// request for an image it already has.
+type validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// newValidators builds the validators for a resized image.  The ETag is a
+// hash of both the cache key and the image data, so it changes if either the
+// request or the source image does.
+func newValidators(cacheKey string, resized *ResizedImage) *validators {
+	hash := sha1.New()
+	hash.Write([]byte(cacheKey))
+	hash.Write([]byte{0})
+	hash.Write(resized.Data)
+	v := &validators{ETag: `"` + hex.EncodeToString(hash.Sum(nil)) + `"`}
+	if resized.SourceInfo != nil {
+		v.LastModified = resized.SourceInfo.ModTime
+	}
+	return v
+}
+
+// validatorCache is a fixed-size, concurrency-safe LRU of validators by cache
+// key.
+type validatorCache struct {
+	mut   sync.Mutex
+	cache *lru.Cache
+}
+
+func newValidatorCache(maxEntries int) *validatorCache {
+	return &validatorCache{cache: lru.New(maxEntries)}
+}
+
+func (vc *validatorCache) Get(cacheKey string) (*validators, bool) {
+	vc.mut.Lock()
+	defer vc.mut.Unlock()
+	if v, ok := vc.cache.Get(cacheKey); ok {
+		return v.(*validators), true
+	}
+	return nil, false
+}
+
+func (vc *validatorCache) Add(cacheKey string, v *validators) {
+	vc.mut.Lock()
+	defer vc.mut.Unlock()
+	vc.cache.Add(cacheKey, v)
+}
+
+// notModified checks the request's If-None-Match and If-Modified-Since
+// headers against the validators, and reports whether the client's copy is
+// still good.  As per RFC 7232, If-Modified-Since is ignored when
+// If-None-Match is present.
+func notModified(r *http.Request, v *validators) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, etag := range strings.Split(inm, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == "*" || etag == v.ETag {
+				return true
+			}
+		}
+		return false
+	}
+	if v.LastModified.IsZero() {
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates only have second precision
+	return !v.LastModified.Truncate(time.Second).After(ims)
+}
+
+// setCachingHeaders sets the ETag, Last-Modified, Cache-Control and Vary
+// headers for an image response.
+func (app *App) setCachingHeaders(w http.ResponseWriter, v *validators) {
+	w.Header().Set("ETag", v.ETag)
+	if len(app.VaryHeaders) > 0 {
+		w.Header().Set("Vary", strings.Join(app.VaryHeaders, ", "))
+	}
+	if !v.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", v.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if app.CacheMaxAge > 0 {
+		w.Header().Set(
+			"Cache-Control",
+			fmt.Sprintf("public, max-age=%d", int64(app.CacheMaxAge/time.Second)),
+		)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+}
@@ -0,0 +1,149 @@
+package slimgfast
+
+import (
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// Defaults for the placeholder images served when App.ErrorImages is on.
+const (
+	DEFAULT_ERROR_IMAGE_WIDTH  = 100
+	DEFAULT_ERROR_IMAGE_HEIGHT = 100
+)
+
+var DEFAULT_ERROR_IMAGE_COLOR = color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+var DEFAULT_ERROR_IMAGE_TEXT_COLOR = color.RGBA{0x88, 0x88, 0x88, 0xff}
+
+// errorImageSize works out the dimensions of the placeholder image for a
+// request, keeping within the App's limits.
+func (app *App) errorImageSize(req *ImageRequest) (int, int) {
+	width, height := DEFAULT_ERROR_IMAGE_WIDTH, DEFAULT_ERROR_IMAGE_HEIGHT
+	if req != nil {
+		switch {
+		case req.Width > 0 && req.Height > 0:
+			width, height = req.Width, req.Height
+		case req.Width > 0:
+			width, height = req.Width, req.Width
+		case req.Height > 0:
+			width, height = req.Height, req.Height
+		}
+	}
+	if app.MaxWidth > 0 && width > app.MaxWidth {
+		width = app.MaxWidth
+	}
+	if app.MaxHeight > 0 && height > app.MaxHeight {
+		height = app.MaxHeight
+	}
+	return width, height
+}
+
+// errorImageFormat picks the format for the placeholder image: whatever the
+// request asked for, or else whatever the requested file's extension implies.
+func errorImageFormat(req *ImageRequest) string {
+	if req == nil {
+		return FORMAT_JPEG
+	}
+	if req.Format != "" {
+		return req.Format
+	}
+	if parsedUrl, err := url.Parse(req.Url); err == nil {
+		ext := path.Ext(parsedUrl.Path)
+		if len(ext) > 1 {
+			if format, err := normalizeFormat(ext[1:]); err == nil {
+				return format
+			}
+		}
+	}
+	return FORMAT_JPEG
+}
+
+// renderErrorImage draws a solid placeholder image with the given text (if
+// any) centered on it.
+func renderErrorImage(width, height int, bg color.Color, fg color.Color, text string) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	if text == "" {
+		return img
+	}
+	face := basicfont.Face7x13
+	drawer := &font.Drawer{Dst: img, Src: image.NewUniform(fg), Face: face}
+	textWidth := drawer.MeasureString(text)
+	metrics := face.Metrics()
+	textHeight := metrics.Ascent + metrics.Descent
+	// Don't bother if the text won't fit.
+	if textWidth > fixed.I(width) || textHeight > fixed.I(height) {
+		return img
+	}
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(width) - textWidth) / 2,
+		Y: (fixed.I(height)-textHeight)/2 + metrics.Ascent,
+	}
+	drawer.DrawString(text)
+	return img
+}
+
+// writeErrorImage renders and writes out a placeholder image for a failed
+// request, using the original error status.
+func (app *App) writeErrorImage(status int, w http.ResponseWriter, r *http.Request, req *ImageRequest) error {
+	width, height := app.errorImageSize(req)
+	bg := app.ErrorImageColor
+	if bg == nil {
+		bg = DEFAULT_ERROR_IMAGE_COLOR
+	}
+	fg := app.ErrorImageTextColor
+	if fg == nil {
+		fg = DEFAULT_ERROR_IMAGE_TEXT_COLOR
+	}
+	text := app.ErrorImageText
+	if text == "" {
+		text = strconv.Itoa(status)
+	}
+	img := renderErrorImage(width, height, bg, fg, text)
+	format := errorImageFormat(req)
+	data, err := encodeImage(img, img, format, 0)
+	if err != nil {
+		return err
+	}
+	writeErrorData(status, formatContentTypes[format], data, w, r)
+	return nil
+}
+
+// writeFallbackImage serves App.FallbackImagePath, resized just like the
+// original request would have been, in place of an image that wasn't found.
+func (app *App) writeFallbackImage(status int, w http.ResponseWriter, r *http.Request, req *ImageRequest) error {
+	fallbackReq := *req
+	fallbackUrl := url.URL{Path: app.FallbackImagePath}
+	if parsedUrl, err := url.Parse(req.Url); err == nil {
+		fallbackUrl.RawQuery = parsedUrl.RawQuery
+	}
+	fallbackReq.Url = fallbackUrl.String()
+	if err := app.setSourceVersion(r.Context(), &fallbackReq); err != nil {
+		return err
+	}
+	data, _, err := app.getImage(r.Context(), &fallbackReq)
+	if err != nil {
+		return err
+	}
+	writeErrorData(status, ContentTypeFor(&fallbackReq, data), data, w, r)
+	return nil
+}
+
+// writeErrorData writes out an image in response to a failed request.  These
+// are never cached, so that the real image shows up as soon as it can.
+func writeErrorData(status int, contentType string, data []byte, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
@@ -0,0 +1,127 @@
+package slimgfast
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// These are the kinds of errors that can happen while serving an image.
+// Fetchers should wrap their errors with one of them using NewError (or return
+// them directly), so that the App can respond with the right status code.
+var (
+	// ErrMethodNotAllowed means the request used a method other than GET or
+	// HEAD.
+	ErrMethodNotAllowed = errors.New("Method not allowed.")
+	// ErrBadRequest means the request URL couldn't be understood.
+	ErrBadRequest = errors.New("Bad image request.")
+	// ErrBadDimensions is returned when the requested dimensions (or the
+	// dimensions derived from them) are too large or otherwise invalid.
+	ErrBadDimensions = errors.New("Bad image dimensions requested.")
+	// ErrNotFound means the source image doesn't exist.
+	ErrNotFound = errors.New("Image not found.")
+	// ErrForbidden means we aren't allowed to read the source image.
+	ErrForbidden = errors.New("Access to image forbidden.")
+	// ErrUpstreamUnavailable means the source of the image failed, or
+	// couldn't be reached.
+	ErrUpstreamUnavailable = errors.New("Image source unavailable.")
+	// ErrTimeout means the source of the image took too long to respond.
+	ErrTimeout = errors.New("Timed out fetching image.")
+	// ErrOverloaded means there are too many images waiting to be resized
+	// already, and the client should try again later.
+	ErrOverloaded = errors.New("Too busy, try again later.")
+	// ErrSourceTooLarge means the source image is more bytes than we're
+	// willing to fetch.
+	ErrSourceTooLarge = errors.New("Source image too large.")
+	// ErrTooManyPixels means the source image has more pixels than we're
+	// willing to decode, as a decompression bomb might.
+	ErrTooManyPixels = errors.New("Source image has too many pixels.")
+	// ErrUnsupportedImage means the source image couldn't be decoded, either
+	// because it's in a format we don't support or because it's corrupt.
+	ErrUnsupportedImage = errors.New("Unsupported or corrupt image.")
+)
+
+// errorStatuses maps each kind of error to the HTTP status code it's served
+// with.
+var errorStatuses = []struct {
+	kind   error
+	status int
+}{
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed},
+	{ErrBadRequest, http.StatusBadRequest},
+	{ErrBadDimensions, http.StatusBadRequest},
+	{ErrNotFound, http.StatusNotFound},
+	{ErrForbidden, http.StatusForbidden},
+	{ErrUpstreamUnavailable, http.StatusBadGateway},
+	{ErrTimeout, http.StatusGatewayTimeout},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout},
+	// Only seen by clients that are still there when a load they were
+	// sharing was called off by another client, so they can try again.
+	{context.Canceled, http.StatusServiceUnavailable},
+	{ErrUnsupportedImage, http.StatusUnsupportedMediaType},
+	{ErrOverloaded, http.StatusServiceUnavailable},
+	{ErrSourceTooLarge, http.StatusRequestEntityTooLarge},
+	{ErrTooManyPixels, http.StatusUnprocessableEntity},
+}
+
+// Error is an error of one of the kinds above, along with the underlying
+// error that caused it.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// NewError wraps err as an error of the given kind.
+func NewError(kind error, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + " " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, kind) work for the error's kind.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// StatusForError returns the HTTP status code that an error should be served
+// with.  Errors of unknown kinds are internal server errors.
+func StatusForError(err error) int {
+	for _, es := range errorStatuses {
+		if errors.Is(err, es.kind) {
+			return es.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// publicErrorMessage returns the message to show to the client for an error.
+// Errors caused by the request itself are shown in full, but for anything
+// else we show only the kind of error, to avoid leaking internal details.
+func publicErrorMessage(err error) string {
+	if errors.Is(err, ErrBadRequest) || errors.Is(err, ErrBadDimensions) {
+		return err.Error()
+	}
+	for _, es := range errorStatuses {
+		if errors.Is(err, es.kind) {
+			return es.kind.Error()
+		}
+	}
+	return http.StatusText(http.StatusInternalServerError)
+}
+
+// contextError turns the error from a finished context into an error of the
+// right kind: running out of time is a timeout, but cancellation is passed
+// through as is.
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return NewError(ErrTimeout, err)
+	}
+	return err
+}
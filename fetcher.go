@@ -1,6 +1,16 @@
 package slimgfast
 
-import "github.com/golang/groupcache"
+import (
+	"context"
+	"github.com/golang/groupcache"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_MAX_SOURCE_BYTES is the largest source image the bundled fetchers
+// will fetch by default.  Bigger images are refused with ErrSourceTooLarge.
+const DEFAULT_MAX_SOURCE_BYTES = 32 << 20
 
 // Fetcher is the interface that is used to fetch images from some source,
 // which could be the filesystem, a remote URL, or S3 -- but it could be from
@@ -8,3 +18,114 @@ import "github.com/golang/groupcache"
 type Fetcher interface {
 	Fetch(urlPath string, dest groupcache.Sink) error
 }
+
+// SourceInfo holds whatever a Fetcher knows about a source image beyond its
+// bytes.  Any of the fields may be left as their zero value if unknown.
+type SourceInfo struct {
+	ModTime time.Time
+	// Size is the size of the source image in bytes.
+	Size int64
+}
+
+// Version identifies this version of the source image, so that images
+// resized from an older version can be told apart.  It's empty if the
+// Fetcher didn't report enough to tell.
+func (info *SourceInfo) Version() string {
+	if info.ModTime.IsZero() && info.Size == 0 {
+		return ""
+	}
+	return strconv.FormatInt(info.ModTime.UnixNano(), 36) + "-" + strconv.FormatInt(info.Size, 36)
+}
+
+// InfoFetcher is an optional interface for Fetchers that can report more about
+// the images they fetch, like when they were last modified.  If a Fetcher
+// implements it, FetchInfo is called instead of Fetch.
+type InfoFetcher interface {
+	FetchInfo(urlPath string, dest groupcache.Sink) (*SourceInfo, error)
+}
+
+// ContextFetcher is an optional interface for Fetchers that can be cancelled,
+// or given a deadline, through a context.  It's preferred over both Fetch and
+// FetchInfo when a Fetcher implements it.
+type ContextFetcher interface {
+	FetchContext(ctx context.Context, urlPath string, dest groupcache.Sink) (*SourceInfo, error)
+}
+
+// StatFetcher is an optional interface for Fetchers that can cheaply look up
+// a source image's SourceInfo without fetching it, like the filesystem can.
+// If a Fetcher implements it, the App checks each source image's version
+// every so often (see App.SourceCheckInterval), and resizes it again once it
+// has changed.
+type StatFetcher interface {
+	Stat(ctx context.Context, urlPath string) (*SourceInfo, error)
+}
+
+type requestHeaderKey struct{}
+
+// WithRequestHeader returns a copy of the context which carries the headers
+// of the client request that it's serving, so that fetchers can pass some of
+// them on to the origin.
+func WithRequestHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, requestHeaderKey{}, header)
+}
+
+// RequestHeaderFromContext returns the client request headers set on the
+// context with WithRequestHeader, or nil if there aren't any, as with
+// prewarming.  Only the request that causes an image to be fetched has its
+// headers seen, since the image is cached for everyone after that.
+func RequestHeaderFromContext(ctx context.Context) http.Header {
+	header, _ := ctx.Value(requestHeaderKey{}).(http.Header)
+	return header
+}
+
+// NewContextFetcher adapts any Fetcher into a ContextFetcher.  Fetchers which
+// already implement ContextFetcher are returned as they are.  Any others are
+// run in their own goroutine, and while they can't actually be stopped, the
+// caller stops waiting for them as soon as the context is done.
+func NewContextFetcher(fetcher Fetcher) ContextFetcher {
+	if contextFetcher, ok := fetcher.(ContextFetcher); ok {
+		return contextFetcher
+	}
+	return &contextFetcherAdapter{fetcher: fetcher}
+}
+
+type contextFetcherAdapter struct {
+	fetcher Fetcher
+}
+
+type fetchResult struct {
+	data []byte
+	info *SourceInfo
+	err  error
+}
+
+func (a *contextFetcherAdapter) FetchContext(ctx context.Context, urlPath string, dest groupcache.Sink) (*SourceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+	// The fetcher gets its own sink, since it may still be running after
+	// we've given up on it and returned.
+	results := make(chan fetchResult, 1)
+	go func() {
+		var result fetchResult
+		sink := groupcache.AllocatingByteSliceSink(&result.data)
+		if infoFetcher, ok := a.fetcher.(InfoFetcher); ok {
+			result.info, result.err = infoFetcher.FetchInfo(urlPath, sink)
+		} else {
+			result.err = a.fetcher.Fetch(urlPath, sink)
+		}
+		results <- result
+	}()
+	select {
+	case result := <-results:
+		if result.err != nil {
+			return nil, result.err
+		}
+		if result.info == nil {
+			result.info = &SourceInfo{}
+		}
+		return result.info, dest.SetBytes(result.data)
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err())
+	}
+}
@@ -0,0 +1,195 @@
+package slimgfast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/groupcache"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowFetcher takes its time before handing back the same bytes for every
+// path.
+type slowFetcher struct {
+	delay time.Duration
+	data  []byte
+}
+
+func (f *slowFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
+	time.Sleep(f.delay)
+	return dest.SetBytes(f.data)
+}
+
+func TestContextFetcherAdapter(t *testing.T) {
+	fetcher := NewContextFetcher(&slowFetcher{delay: 10 * time.Millisecond, data: []byte("img")})
+	var data []byte
+	if _, err := fetcher.FetchContext(context.Background(), "/a.jpg", groupcache.AllocatingByteSliceSink(&data)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(data) != "img" {
+		t.Error("Expected the adapter to pass the data through, got:", string(data))
+	}
+}
+
+func TestContextFetcherAdapterDeadline(t *testing.T) {
+	fetcher := NewContextFetcher(&slowFetcher{delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var data []byte
+	_, err := fetcher.FetchContext(ctx, "/a.jpg", groupcache.AllocatingByteSliceSink(&data))
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("Expected ErrTimeout, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected the adapter to give up at the deadline, took:", elapsed)
+	}
+}
+
+// versionedFetcher serves one image, which can be changed, and implements
+// StatFetcher.
+type versionedFetcher struct {
+	mut     sync.Mutex
+	data    []byte
+	modTime time.Time
+	stats   int
+}
+
+func (f *versionedFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return dest.SetBytes(f.data)
+}
+
+func (f *versionedFetcher) Stat(ctx context.Context, urlPath string) (*SourceInfo, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.stats++
+	return &SourceInfo{ModTime: f.modTime, Size: int64(len(f.data))}, nil
+}
+
+func (f *versionedFetcher) set(data string, modTime time.Time) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.data = []byte(data)
+	f.modTime = modTime
+}
+
+// testGroupName makes a groupcache group name that isn't registered yet,
+// since groups can only be registered once, and tests can be run more than
+// once.
+func testGroupName(name string) string {
+	for i := 1; ; i++ {
+		unique := fmt.Sprintf("%s_%d", name, i)
+		if groupcache.GetGroup(unique) == nil {
+			return unique
+		}
+	}
+}
+
+func TestImageSourceVersions(t *testing.T) {
+	fetcher := &versionedFetcher{}
+	modTime := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetcher.set("one", modTime)
+	src := NewImageSourceCustomCache(fetcher, testGroupName("slimgfast_test_versions"), 1)
+	src.SetStatInterval(time.Hour)
+	ctx := context.Background()
+	req := &ImageRequest{Url: "/a.jpg"}
+
+	getData := func() string {
+		version, err := src.SourceVersion(ctx, req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.SourceVersion = version
+		data, _, err := src.GetImageData(ctx, req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return string(data)
+	}
+
+	if data := getData(); data != "one" {
+		t.Error("Expected the first version, got:", data)
+	}
+	fetcher.set("two", modTime.Add(time.Second))
+	if data := getData(); data != "one" {
+		t.Error("Expected the version to be trusted until it's checked again, got:", data)
+	}
+	if fetcher.stats != 1 {
+		t.Error("Expected one stat within the interval, got:", fetcher.stats)
+	}
+	src.SetStatInterval(time.Nanosecond)
+	if data := getData(); data != "two" {
+		t.Error("Expected the changed image once it's checked again, got:", data)
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	urlPath, version := splitSourceKey(sourceKey("/a\x00b.jpg", "v1"))
+	if urlPath != "/a\x00b.jpg" || version != "v1" {
+		t.Error("Expected the key to split back up, got:", urlPath, version)
+	}
+	if (&SourceInfo{}).Version() != "" {
+		t.Error("Expected no version without a size or modification time")
+	}
+}
+
+// gatedFetcher holds up every fetch until it's released, or its context is
+// done.
+type gatedFetcher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *gatedFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
+	_, err := f.FetchContext(context.Background(), urlPath, dest)
+	return err
+}
+
+func (f *gatedFetcher) FetchContext(ctx context.Context, urlPath string, dest groupcache.Sink) (*SourceInfo, error) {
+	f.started <- struct{}{}
+	select {
+	case <-f.release:
+		return &SourceInfo{}, dest.SetBytes([]byte("img"))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestImageSourceSharedLoadCancelled(t *testing.T) {
+	fetcher := &gatedFetcher{started: make(chan struct{}, 2), release: make(chan struct{})}
+	src := NewImageSourceCustomCache(fetcher, testGroupName("slimgfast_test_shared_load"), 1)
+	req := &ImageRequest{Url: "/a.jpg"}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, _, err := src.GetImageData(firstCtx, req)
+		firstErr <- err
+	}()
+	<-fetcher.started
+
+	secondErr := make(chan error, 1)
+	var secondData []byte
+	go func() {
+		data, _, err := src.GetImageData(context.Background(), req)
+		secondData = data
+		secondErr <- err
+	}()
+	// Wait for the second request to join the load the first one started
+	waitFor(t, "the second request", func() bool { return src.cache.Stats.Loads.Get() == 2 })
+
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Error("Expected the first request to be cancelled, got:", err)
+	}
+	// The second request starts a load of its own
+	<-fetcher.started
+	close(fetcher.release)
+	if err := <-secondErr; err != nil || string(secondData) != "img" {
+		t.Error("Expected the second request to get the image, got:", string(secondData), err)
+	}
+}
@@ -0,0 +1,81 @@
+package fetchers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ericflo/slimgfast"
+	"image"
+	"mime"
+	"strings"
+)
+
+// contentTypeAllowed checks the Content-Type an upstream server sent against
+// the allowed types, which can be exact like "image/png" or wildcards like
+// "image/*".  With no allowed types, any image type is allowed, along with
+// the generic binary types that some servers send for everything.  A missing
+// Content-Type is allowed, and left to sniffing.
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if len(allowed) == 0 {
+		allowed = []string{"image/*", "application/octet-stream", "binary/octet-stream"}
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContentType returns an error if the upstream server sent something
+// other than an image, like an HTML error page served with a 200.
+func checkContentType(contentType string, allowed []string) error {
+	if contentTypeAllowed(contentType, allowed) {
+		return nil
+	}
+	return slimgfast.NewError(
+		slimgfast.ErrUpstreamUnavailable,
+		fmt.Errorf("The upstream server sent %q rather than an image", contentType),
+	)
+}
+
+// sniffImage checks the magic bytes at the start of the data against the
+// image formats that can be decoded, so that anything else is turned away
+// before it gets to a worker.
+func sniffImage(data []byte) error {
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return slimgfast.NewError(
+			slimgfast.ErrUnsupportedImage,
+			errors.New("The source doesn't look like an image in a supported format"),
+		)
+	}
+	return nil
+}
+
+// hostAllowed checks a host name against a list of allowed hosts, which can
+// be exact like "cdn.example.com" or wildcards like "*.example.com", which
+// match any subdomain but not example.com itself.
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package fetchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ericflo/slimgfast"
+	"net"
+	"net/http"
+)
+
+// errorForStatus turns a bad HTTP status code from an upstream server into a
+// slimgfast error of the right kind.
+func errorForStatus(status int) error {
+	err := fmt.Errorf("Got a bad status code back (expected 200, got %d)", status)
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return slimgfast.NewError(slimgfast.ErrNotFound, err)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return slimgfast.NewError(slimgfast.ErrForbidden, err)
+	case status == http.StatusGatewayTimeout:
+		return slimgfast.NewError(slimgfast.ErrTimeout, err)
+	}
+	return slimgfast.NewError(slimgfast.ErrUpstreamUnavailable, err)
+}
+
+// errorForTransport turns an error making a request to an upstream server
+// into a slimgfast error of the right kind.  Errors which already have a kind
+// are left alone.
+func errorForTransport(err error) error {
+	var kindErr *slimgfast.Error
+	if errors.Is(err, context.Canceled) || errors.As(err, &kindErr) {
+		return err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return slimgfast.NewError(slimgfast.ErrTimeout, err)
+	}
+	return slimgfast.NewError(slimgfast.ErrUpstreamUnavailable, err)
+}
@@ -1,23 +1,216 @@
 package fetchers
 
 import (
+	"context"
+	"errors"
+	"github.com/ericflo/slimgfast"
 	"github.com/golang/groupcache"
-	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
 )
 
-// FilesystemFetcher fetches images from the filesystem.
+// The ways FilesystemFetcher.SymlinkPolicy can treat symlinks.
+const (
+	// SYMLINKS_WITHIN_ROOT follows symlinks, as long as they lead to a file
+	// inside the root directory.  This is the default.
+	SYMLINKS_WITHIN_ROOT = "within_root"
+	// SYMLINKS_DENY refuses to follow any symlink under the root directory.
+	SYMLINKS_DENY = "deny"
+	// SYMLINKS_FOLLOW follows symlinks wherever they lead.
+	SYMLINKS_FOLLOW = "follow"
+)
+
+// FilesystemFetcher fetches images from the filesystem.  Only files inside
+// the root directory, PathPrefix, are ever served, whatever the URL path.
 type FilesystemFetcher struct {
 	PathPrefix string
+	// MaxBytes is the largest image that will be read.  Zero means
+	// slimgfast.DEFAULT_MAX_SOURCE_BYTES, and less than zero means no limit.
+	MaxBytes int64
+	// SymlinkPolicy is how symlinks are treated: one of SYMLINKS_WITHIN_ROOT
+	// (the default, if empty), SYMLINKS_DENY or SYMLINKS_FOLLOW.  Any other
+	// policy makes every fetch fail.
+	SymlinkPolicy string
+	// AllowedExtensions, if set, are the only file extensions (like ".jpg")
+	// that will be served.  They're matched case-insensitively.
+	AllowedExtensions []string
 }
 
 // Fetch opens and reads in the image data from the file requested by the user.
 func (f *FilesystemFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
-	filePath := path.Clean(f.PathPrefix + urlPath)
-	data, err := ioutil.ReadFile(filePath)
+	_, err := f.FetchContext(context.Background(), urlPath, dest)
+	return err
+}
+
+// FetchContext opens and reads in the image data from the file requested by
+// the user, unless the context is already done.  The file's size and
+// modification time are reported along with it.
+func (f *FilesystemFetcher) FetchContext(ctx context.Context, urlPath string, dest groupcache.Sink) (*slimgfast.SourceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filePath, err := f.resolvePath(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, slimgfast.NewError(slimgfast.ErrNotFound, errors.New("Is a directory: "+urlPath))
+	}
+	// The size from the stat lets readSource read the file in one go, into a
+	// buffer of the right size.
+	data, err := readSource(file, stat.Size(), f.MaxBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dest.SetBytes(data)
-	return nil
+	return sourceInfoFor(stat), nil
+}
+
+// Stat looks up the size and modification time of the file requested by the
+// user, without reading it, so that the App can tell when it has changed.
+func (f *FilesystemFetcher) Stat(ctx context.Context, urlPath string) (*slimgfast.SourceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filePath, err := f.resolvePath(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	if stat.IsDir() {
+		return nil, slimgfast.NewError(slimgfast.ErrNotFound, errors.New("Is a directory: "+urlPath))
+	}
+	return sourceInfoFor(stat), nil
+}
+
+// sourceInfoFor reports what a file's stat says about the image in it.
+func sourceInfoFor(stat os.FileInfo) *slimgfast.SourceInfo {
+	return &slimgfast.SourceInfo{ModTime: stat.ModTime(), Size: stat.Size()}
+}
+
+// fileError gives errors from opening or statting a file the right kind.
+func fileError(err error) error {
+	if os.IsNotExist(err) {
+		return slimgfast.NewError(slimgfast.ErrNotFound, err)
+	} else if os.IsPermission(err) {
+		return slimgfast.NewError(slimgfast.ErrForbidden, err)
+	}
+	return err
+}
+
+// resolvePath works out which file a URL path refers to, making sure that it's
+// inside the root directory and allowed by the fetcher's settings.
+func (f *FilesystemFetcher) resolvePath(urlPath string) (string, error) {
+	if strings.IndexByte(urlPath, 0) != -1 {
+		return "", slimgfast.NewError(slimgfast.ErrBadRequest, errors.New("Path contains a NUL byte"))
+	}
+	if !f.extensionAllowed(urlPath) {
+		return "", slimgfast.NewError(slimgfast.ErrForbidden, errors.New("File type not allowed: "+urlPath))
+	}
+	// Cleaning the path as an absolute path first means any ".." can only
+	// go as far up as the root.
+	root := filepath.Clean(f.PathPrefix)
+	filePath := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	switch f.SymlinkPolicy {
+	case SYMLINKS_FOLLOW:
+		return filePath, nil
+	case "", SYMLINKS_WITHIN_ROOT, SYMLINKS_DENY:
+	default:
+		return "", errors.New("Unknown symlink policy: " + f.SymlinkPolicy)
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filePath)
+	if os.IsNotExist(err) {
+		return "", slimgfast.NewError(slimgfast.ErrNotFound, err)
+	} else if err != nil {
+		return "", err
+	}
+	if f.SymlinkPolicy == SYMLINKS_DENY {
+		// Without symlinks, the file resolves to the same place under the
+		// root as it's named.
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return "", err
+		}
+		if resolved != filepath.Join(resolvedRoot, rel) {
+			return "", slimgfast.NewError(slimgfast.ErrForbidden, errors.New("Symlinks are not allowed: "+urlPath))
+		}
+	} else if !insideDir(resolvedRoot, resolved) {
+		return "", slimgfast.NewError(slimgfast.ErrForbidden, errors.New("Symlink leads outside the root: "+urlPath))
+	}
+	// Open the file we checked, not the symlink, in case it changes.
+	return resolved, nil
+}
+
+// insideDir reports whether filePath is inside dir.  Both must be clean.
+func insideDir(dir string, filePath string) bool {
+	rel, err := filepath.Rel(dir, filePath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// extensionAllowed checks a path's file extension against AllowedExtensions.
+func (f *FilesystemFetcher) extensionAllowed(filePath string) bool {
+	if len(f.AllowedExtensions) == 0 {
+		return true
+	}
+	ext := path.Ext(filePath)
+	for _, allowed := range f.AllowedExtensions {
+		if strings.EqualFold(ext, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths walks the directory under PathPrefix and returns the URL path of
+// every file in it that it would serve, for prewarming.  Hidden files and
+// directories, and symlinks, are skipped.
+func (f *FilesystemFetcher) Paths() ([]string, error) {
+	root := filepath.Clean(f.PathPrefix)
+	paths := []string{}
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !f.extensionAllowed(filePath) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, "/"+filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
 }
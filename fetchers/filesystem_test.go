@@ -0,0 +1,170 @@
+package fetchers
+
+import (
+	"context"
+	"errors"
+	"github.com/ericflo/slimgfast"
+	"github.com/golang/groupcache"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// makeTestTree lays out an images directory, with a private directory beside
+// it that shouldn't be reachable, and returns the base directory.
+func makeTestTree(t *testing.T) string {
+	base, err := ioutil.TempDir("", "slimgfast_filesystem")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	files := map[string]string{
+		"images/a.jpg":                 "a",
+		"images/c.JPG":                 "c",
+		"images/notes.txt":             "notes",
+		"images/sub/b.png":             "b",
+		"images/.hidden/h.jpg":         "h",
+		"images-private/secret.jpg":    "secret",
+		"images/images-private/x.jpg.": "x",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	links := map[string]string{
+		"images/link-inside.jpg":  "sub/b.png",
+		"images/link-outside.jpg": "../images-private/secret.jpg",
+		"images/linked-dir":       "../images-private",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Skip("Can't make symlinks here: " + err.Error())
+		}
+	}
+	return base
+}
+
+func TestFilesystemFetcherStaysInRoot(t *testing.T) {
+	base := makeTestTree(t)
+	defer os.RemoveAll(base)
+	root := filepath.Join(base, "images")
+	within := &FilesystemFetcher{PathPrefix: root}
+	deny := &FilesystemFetcher{PathPrefix: root, SymlinkPolicy: SYMLINKS_DENY}
+	follow := &FilesystemFetcher{PathPrefix: root, SymlinkPolicy: SYMLINKS_FOLLOW}
+	images := &FilesystemFetcher{PathPrefix: root, AllowedExtensions: []string{".jpg", ".png"}}
+
+	tests := []struct {
+		fetcher *FilesystemFetcher
+		rawPath string
+		want    string
+		kind    error
+	}{
+		{within, "/a.jpg", "a", nil},
+		{within, "//a.jpg", "a", nil},
+		{within, "/sub/../a.jpg", "a", nil},
+		{within, "/sub//b.png", "b", nil},
+		// Escaping to the sibling directory
+		{within, "/../images-private/secret.jpg", "", slimgfast.ErrNotFound},
+		{within, "/%2e%2e/images-private/secret.jpg", "", slimgfast.ErrNotFound},
+		{within, "/%2E%2E%2fimages-private%2fsecret.jpg", "", slimgfast.ErrNotFound},
+		{within, "//../../images-private/secret.jpg", "", slimgfast.ErrNotFound},
+		{follow, "/sub/../../images-private/secret.jpg", "", slimgfast.ErrNotFound},
+		{within, "/sub", "", slimgfast.ErrNotFound},
+		// Symlinks
+		{within, "/link-inside.jpg", "b", nil},
+		{within, "/link-outside.jpg", "", slimgfast.ErrForbidden},
+		{within, "/linked-dir/secret.jpg", "", slimgfast.ErrForbidden},
+		{deny, "/a.jpg", "a", nil},
+		{deny, "/link-inside.jpg", "", slimgfast.ErrForbidden},
+		{deny, "/link-outside.jpg", "", slimgfast.ErrForbidden},
+		{follow, "/link-outside.jpg", "secret", nil},
+		// Extensions
+		{images, "/a.jpg", "a", nil},
+		{images, "/c.JPG", "c", nil},
+		{images, "/notes.txt", "", slimgfast.ErrForbidden},
+		{images, "/images-private/x.jpg.", "", slimgfast.ErrForbidden},
+	}
+	for _, test := range tests {
+		// Decode the path the same way the ImageSource does
+		parsedUrl, err := url.ParseRequestURI(test.rawPath)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var data []byte
+		_, err = test.fetcher.FetchContext(context.Background(), parsedUrl.Path, groupcache.AllocatingByteSliceSink(&data))
+		if test.kind != nil {
+			if !errors.Is(err, test.kind) {
+				t.Errorf("Expected %q (%s) to fail with %v, got: %q %v", test.rawPath, test.fetcher.SymlinkPolicy, test.kind, data, err)
+			}
+		} else if err != nil || string(data) != test.want {
+			t.Errorf("Expected %q (%s) to be %q, got: %q %v", test.rawPath, test.fetcher.SymlinkPolicy, test.want, data, err)
+		}
+	}
+
+	// A mistyped policy doesn't quietly fall back to another one
+	typo := &FilesystemFetcher{PathPrefix: root, SymlinkPolicy: "folow"}
+	var data []byte
+	if _, err := typo.FetchContext(context.Background(), "/a.jpg", groupcache.AllocatingByteSliceSink(&data)); err == nil {
+		t.Error("Expected an unknown symlink policy to be an error")
+	}
+}
+
+func TestFilesystemFetcherPaths(t *testing.T) {
+	base := makeTestTree(t)
+	defer os.RemoveAll(base)
+	fetcher := &FilesystemFetcher{
+		PathPrefix:        filepath.Join(base, "images"),
+		AllowedExtensions: []string{".jpg", ".png"},
+	}
+	paths, err := fetcher.Paths()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{"/a.jpg", "/c.JPG", "/sub/b.png"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Error("Expected", expected, "got:", paths)
+	}
+}
+
+func TestFilesystemFetcherStat(t *testing.T) {
+	base := makeTestTree(t)
+	defer os.RemoveAll(base)
+	fetcher := &FilesystemFetcher{PathPrefix: filepath.Join(base, "images")}
+	modTime := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(base, "images", "notes.txt"), modTime, modTime); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	info, err := fetcher.Stat(context.Background(), "/notes.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !info.ModTime.Equal(modTime) || info.Size != 5 {
+		t.Error("Expected the file's modification time and size, got:", info.ModTime, info.Size)
+	}
+	var data []byte
+	fetched, err := fetcher.FetchContext(context.Background(), "/notes.txt", groupcache.AllocatingByteSliceSink(&data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !fetched.ModTime.Equal(info.ModTime) || fetched.Size != info.Size {
+		t.Error("Expected FetchContext to report the same as Stat, got:", fetched, info)
+	}
+
+	for _, urlPath := range []string{"/missing.jpg", "/sub", "/../images-private/secret.jpg"} {
+		if _, err := fetcher.Stat(context.Background(), urlPath); !errors.Is(err, slimgfast.ErrNotFound) {
+			t.Error("Expected", urlPath, "to be not found, got:", err)
+		}
+	}
+	if _, err := fetcher.Stat(context.Background(), "/link-outside.jpg"); !errors.Is(err, slimgfast.ErrForbidden) {
+		t.Error("Expected the symlink out of the root to be forbidden, got:", err)
+	}
+}
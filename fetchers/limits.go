@@ -0,0 +1,75 @@
+package fetchers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ericflo/slimgfast"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// maxBytesOrDefault works out a fetcher's byte limit from its MaxBytes field,
+// where zero means slimgfast.DEFAULT_MAX_SOURCE_BYTES and less than zero
+// means no limit.
+func maxBytesOrDefault(maxBytes int64) int64 {
+	if maxBytes == 0 {
+		return slimgfast.DEFAULT_MAX_SOURCE_BYTES
+	}
+	return maxBytes
+}
+
+// durationOrDefault works out a fetcher's timeout from one of its fields,
+// where zero means the given default and less than zero means no limit.
+func durationOrDefault(d time.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// readSource reads in a source image, giving up with ErrSourceTooLarge as
+// soon as it's clear the image is over the byte limit.  If the size of the
+// image is known up front it's checked before reading anything, otherwise
+// pass -1.
+func readSource(r io.Reader, size int64, maxBytes int64) ([]byte, error) {
+	maxBytes = maxBytesOrDefault(maxBytes)
+	if maxBytes < 0 {
+		return ioutil.ReadAll(r)
+	}
+	if size > maxBytes {
+		return nil, tooLarge(maxBytes)
+	}
+	// Read one byte past the limit, to tell whether there was more
+	limited := io.LimitReader(r, maxBytes+1)
+	if size < 0 {
+		data, err := ioutil.ReadAll(limited)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > maxBytes {
+			return nil, tooLarge(maxBytes)
+		}
+		return data, nil
+	}
+	// The size is known, so read straight into a buffer big enough for all
+	// of it, with room to spare in case it grew.
+	buf := bytes.NewBuffer(make([]byte, 0, size+bytes.MinRead))
+	if _, err := buf.ReadFrom(limited); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > maxBytes {
+		return nil, tooLarge(maxBytes)
+	}
+	return buf.Bytes(), nil
+}
+
+func tooLarge(maxBytes int64) error {
+	return slimgfast.NewError(
+		slimgfast.ErrSourceTooLarge,
+		fmt.Errorf("The source image is over the limit of %d bytes", maxBytes),
+	)
+}
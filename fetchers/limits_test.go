@@ -0,0 +1,89 @@
+package fetchers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ericflo/slimgfast"
+	"github.com/golang/groupcache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSource(t *testing.T) {
+	tests := []struct {
+		data     string
+		size     int64
+		maxBytes int64
+		tooLarge bool
+	}{
+		{"12345", -1, 5, false},
+		{"123456", -1, 5, true},
+		{"12345", 6, 5, true},
+		{"123456", -1, -1, false},
+		{"123456", -1, 0, false},
+	}
+	for _, test := range tests {
+		data, err := readSource(strings.NewReader(test.data), test.size, test.maxBytes)
+		if test.tooLarge {
+			if !errors.Is(err, slimgfast.ErrSourceTooLarge) {
+				t.Error("Expected", test.data, "to be too large, got:", err)
+			}
+		} else if err != nil || string(data) != test.data {
+			t.Error("Expected", test.data, "got:", string(data), err)
+		}
+	}
+}
+
+func TestFetchersMaxBytes(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		if r.URL.Path == "/chunked.jpg" {
+			// No Content-Length, so the limit has to be enforced while reading
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write(data[:50])
+			w.(http.Flusher).Flush()
+			w.Write(data[50:])
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "slimgfast_fetchers")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "big.jpg"), data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		fetcher slimgfast.ContextFetcher
+		urlPath string
+	}{
+		{&ProxyFetcher{ProxyUrlPrefix: server.URL, MaxBytes: 99}, "/big.jpg"},
+		{&ProxyFetcher{ProxyUrlPrefix: server.URL, MaxBytes: 99}, "/chunked.jpg"},
+		{&FilesystemFetcher{PathPrefix: dir, MaxBytes: 99}, "/big.jpg"},
+	}
+	for _, test := range tests {
+		var fetched []byte
+		_, err := test.fetcher.FetchContext(context.Background(), test.urlPath, groupcache.AllocatingByteSliceSink(&fetched))
+		if !errors.Is(err, slimgfast.ErrSourceTooLarge) {
+			t.Errorf("Expected %T to refuse %s, got: %v", test.fetcher, test.urlPath, err)
+		}
+	}
+
+	var fetched []byte
+	fetcher := &FilesystemFetcher{PathPrefix: dir, MaxBytes: 100}
+	if _, err := fetcher.FetchContext(context.Background(), "/big.jpg", groupcache.AllocatingByteSliceSink(&fetched)); err != nil {
+		t.Error("Expected an image right at the limit to be fetched, got:", err)
+	}
+}
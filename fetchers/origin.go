@@ -0,0 +1,165 @@
+package fetchers
+
+import (
+	"context"
+	"errors"
+	"github.com/ericflo/slimgfast"
+	"github.com/golang/groupcache"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+)
+
+// blockedNetworks are the address ranges MultiOriginFetcher won't connect to:
+// loopback, private, link-local (including cloud metadata services), and
+// other addresses that aren't on the public internet.  The IPv6 ranges that
+// carry an IPv4 address inside them (IPv4-compatible, NAT64, Teredo and 6to4)
+// are blocked outright, since they can lead to internal IPv4 addresses.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/96",
+	"::1/128",
+	"64:ff9b::/96",
+	"2001::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// MultiOriginFetcher fetches images from any of a list of allowed HTTP
+// servers, given the full URL of the image.  The URL is encoded into the path
+// with slimgfast.SourcePath, or passed in the slimgfast.SOURCE_URL_PARAM
+// query parameter, which the App moves into the path.
+//
+// To stop it being used to reach internal services, it only connects to
+// public IP addresses, which is checked after the host name is resolved, and
+// for every redirect.  The embedded ProxyFetcher's settings all apply, except
+// for ProxyUrlPrefix, and redirects may also lead to any of AllowedHosts.
+//
+// Credentials and other headers can't be scoped to one of the hosts, so
+// rather than send them to every host, the fetcher refuses to fetch anything
+// if the ProxyFetcher's Headers, ForwardHeaders, BearerToken or Username are
+// set.
+type MultiOriginFetcher struct {
+	ProxyFetcher
+	// AllowedHosts are the hosts images may be fetched from.  They can be
+	// exact like "cdn.example.com" or wildcards like "*.example.com".  If
+	// empty, nothing can be fetched.
+	AllowedHosts []string
+	// AllowPrivateNetworks turns off the check that only public IP addresses
+	// are connected to.  Without it, the embedded ProxyFetcher's Client must
+	// not be set, since the check is made by the fetcher's own client.
+	AllowPrivateNetworks bool
+	setupOnce            sync.Once
+}
+
+// Fetch fetches the image whose URL is encoded in the path.
+func (f *MultiOriginFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
+	_, err := f.FetchContext(context.Background(), urlPath, dest)
+	return err
+}
+
+// FetchContext fetches the image whose URL is encoded in the path, as long as
+// it's on one of the allowed hosts, giving up if the context is done first.
+func (f *MultiOriginFetcher) FetchContext(ctx context.Context, urlPath string, dest groupcache.Sink) (*slimgfast.SourceInfo, error) {
+	f.setupOnce.Do(func() {
+		f.ProxyFetcher.originHosts = f.AllowedHosts
+		if !f.AllowPrivateNetworks {
+			f.ProxyFetcher.dialControl = checkPublicAddress
+		}
+	})
+	if !f.AllowPrivateNetworks && f.Client != nil {
+		return nil, errors.New("MultiOriginFetcher can't check the addresses a custom Client connects to")
+	}
+	if len(f.Headers) > 0 || len(f.ForwardHeaders) > 0 || f.BearerToken != "" || f.Username != "" {
+		return nil, errors.New("MultiOriginFetcher won't send headers or credentials to every allowed host")
+	}
+	sourceUrl, err := f.sourceURL(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.get(ctx, sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+	return f.readResponse(resp, dest)
+}
+
+// sourceURL decodes the URL of the image from the path, and checks that it's
+// an HTTP URL on one of the allowed hosts.
+func (f *MultiOriginFetcher) sourceURL(urlPath string) (string, error) {
+	rawUrl, err := slimgfast.SourceURLFromPath(urlPath)
+	if err != nil {
+		return "", err
+	}
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", slimgfast.NewError(slimgfast.ErrBadRequest, err)
+	}
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return "", slimgfast.NewError(slimgfast.ErrBadRequest, errors.New("Only HTTP and HTTPS source URLs are allowed"))
+	}
+	if parsedUrl.User != nil {
+		return "", slimgfast.NewError(slimgfast.ErrBadRequest, errors.New("Source URLs can't have credentials in them"))
+	}
+	if !hostAllowed(parsedUrl.Hostname(), f.AllowedHosts) {
+		return "", slimgfast.NewError(slimgfast.ErrForbidden, errors.New("Host not allowed: "+parsedUrl.Hostname()))
+	}
+	return parsedUrl.String(), nil
+}
+
+// checkPublicAddress is a net.Dialer Control function that refuses to connect
+// to anything but public IP addresses.  It's called with the address that the
+// host name resolved to, just before connecting, so DNS can't be used to get
+// around it.
+func checkPublicAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return slimgfast.NewError(
+			slimgfast.ErrForbidden,
+			errors.New("Refusing to connect to non-public address "+host),
+		)
+	}
+	return nil
+}
+
+// publicIP reports whether an IP address is on the public internet.
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
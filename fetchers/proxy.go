@@ -1,38 +1,364 @@
 package fetchers
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/ericflo/slimgfast"
 	"github.com/golang/groupcache"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// DEFAULT_USER_AGENT is the User-Agent that ProxyFetcher sends by default.
+const DEFAULT_USER_AGENT = "slimgfast"
+
+// Defaults for ProxyFetcher's HTTP client.
+const (
+	DEFAULT_CONNECT_TIMEOUT = 5 * time.Second
+	DEFAULT_READ_TIMEOUT    = 15 * time.Second
+	DEFAULT_MAX_IDLE_CONNS  = 100
+	DEFAULT_RETRY_BACKOFF   = 100 * time.Millisecond
+)
+
+// DEFAULT_MAX_REDIRECTS is how many redirects ProxyFetcher follows by default.
+const DEFAULT_MAX_REDIRECTS = 5
+
+// MAX_RETRY_BACKOFF caps how long ProxyFetcher waits between retries, however
+// many times it has retried.
+const MAX_RETRY_BACKOFF = 5 * time.Second
+
 // ProxyFetcher fetches images from an HTTP server.
 type ProxyFetcher struct {
 	ProxyUrlPrefix string
+	// MaxBytes is the largest image that will be fetched.  Zero means
+	// slimgfast.DEFAULT_MAX_SOURCE_BYTES, and less than zero means no limit.
+	MaxBytes int64
+	// Client, if set, is used to make the requests, and the timeout and
+	// connection settings below are ignored.  Its redirect policy is
+	// replaced with the fetcher's own.
+	Client *http.Client
+	// ConnectTimeout is how long connecting to the server may take.
+	// ReadTimeout is how long the server has to start responding once the
+	// request is sent, and then again to send the whole image, even if the
+	// fetch has no other deadline.  Zero means DEFAULT_CONNECT_TIMEOUT and
+	// DEFAULT_READ_TIMEOUT, and less than zero means no limit.  ReadTimeout
+	// applies to the body even when Client is set.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	// MaxIdleConns is how many idle connections to the server are kept open
+	// for reuse.  Zero means DEFAULT_MAX_IDLE_CONNS.
+	MaxIdleConns int
+	// UserAgent is sent with every request.  Empty means DEFAULT_USER_AGENT.
+	UserAgent string
+	// Headers are sent with every request.
+	Headers http.Header
+	// ForwardHeaders are the names of headers to pass on from the client's
+	// request, when there is one.  The image is cached for everyone once
+	// fetched, so these shouldn't change which image the server sends back.
+	ForwardHeaders []string
+	// BearerToken, if set, is sent in the Authorization header.  Otherwise,
+	// if Username is set, basic auth is used.
+	BearerToken string
+	Username    string
+	Password    string
+	// MaxRetries is how many more times to try a request that failed with a
+	// 5xx or a network error.  Zero means requests aren't retried.
+	MaxRetries int
+	// RetryBackoff is how long to wait before the first retry, and doubles
+	// for each one after that.  A random jitter of up to half of it is taken
+	// off, so that retries from many requests are spread out.  Zero means
+	// DEFAULT_RETRY_BACKOFF.
+	RetryBackoff time.Duration
+	// AllowedContentTypes are the Content-Types the server may send images
+	// with, like "image/png" or "image/*".  Empty allows any image type, and
+	// application/octet-stream.  Whatever the server says, images that don't
+	// start like a supported image format are refused.
+	AllowedContentTypes []string
+	// MaxRedirects is how many redirects are followed before giving up.
+	// Zero means DEFAULT_MAX_REDIRECTS, and less than zero means none are.
+	MaxRedirects int
+	// RedirectHosts are the hosts, besides the one the request was made to,
+	// that redirects may lead to.  They can be exact like "cdn.example.com"
+	// or wildcards like "*.example.com".
+	RedirectHosts []string
+	// originHosts are more hosts that redirects may lead to, and
+	// dialControl vets each address that's connected to.  They're set by
+	// MultiOriginFetcher, and must be set before the first fetch.
+	originHosts []string
+	dialControl func(network, address string, c syscall.RawConn) error
+	clientOnce  sync.Once
+	client      *http.Client
 }
 
 // Fetch makes an HTTP GET request to fetch the image data requested by the
 // user.
 func (f *ProxyFetcher) Fetch(urlPath string, dest groupcache.Sink) error {
-	fullUrl := f.ProxyUrlPrefix + urlPath
-	resp, err := http.Get(fullUrl)
+	_, err := f.FetchContext(context.Background(), urlPath, dest)
+	return err
+}
+
+// FetchContext makes an HTTP GET request to fetch the image data requested by
+// the user, giving up if the context is done first, and reports the
+// Last-Modified time the server sent along with it.
+func (f *ProxyFetcher) FetchContext(ctx context.Context, urlPath string, dest groupcache.Sink) (*slimgfast.SourceInfo, error) {
+	resp, err := f.get(ctx, f.ProxyUrlPrefix+urlPath)
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		errStr := fmt.Sprintf(
-			"Got a bad status code back (expected 200, got %d)",
-			resp.StatusCode,
-		)
-		return errors.New(errStr)
+		return nil, err
 	}
+	return f.readResponse(resp, dest)
+}
+
+// readResponse reads the image out of a successful response, after checking
+// that it really is an image, and closes the response.
+func (f *ProxyFetcher) readResponse(resp *http.Response, dest groupcache.Sink) (*slimgfast.SourceInfo, error) {
 	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
+	if err := checkContentType(resp.Header.Get("Content-Type"), f.AllowedContentTypes); err != nil {
+		return nil, err
+	}
+	data, err := readSource(resp.Body, resp.ContentLength, f.MaxBytes)
 	if err != nil {
-		return err
+		return nil, errorForTransport(err)
+	}
+	if err = sniffImage(data); err != nil {
+		return nil, err
 	}
 	dest.SetBytes(data)
+	return sourceInfoFromResponse(resp), nil
+}
+
+// get makes a GET request to the server, retrying it if it fails in a way
+// that might not happen again.  The response it returns is always a 200.
+func (f *ProxyFetcher) get(ctx context.Context, fullUrl string) (*http.Response, error) {
+	req, err := f.newRequest(ctx, fullUrl)
+	if err != nil {
+		return nil, slimgfast.NewError(slimgfast.ErrBadRequest, err)
+	}
+	client := f.httpClient()
+	readTimeout := durationOrDefault(f.ReadTimeout, DEFAULT_READ_TIMEOUT)
+	for attempt := 0; ; attempt++ {
+		// Each attempt gets its own context, so that reading the body can
+		// be cut off without calling off the whole fetch.
+		attemptCtx, cancel := context.WithCancel(ctx)
+		resp, err := client.Do(req.WithContext(attemptCtx))
+		if err == nil {
+			resp.Body = newTimeoutBody(resp.Body, readTimeout, cancel)
+			if resp.StatusCode == http.StatusOK {
+				return resp, nil
+			}
+		} else {
+			cancel()
+		}
+		retry := false
+		if err != nil {
+			// Errors that already have a kind, like redirects that aren't
+			// allowed, would only happen again.
+			var kindErr *slimgfast.Error
+			retry = ctx.Err() == nil && !errors.As(err, &kindErr)
+			err = errorForTransport(err)
+		} else {
+			// Read a little of the body, so the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+			err = errorForStatus(resp.StatusCode)
+			retry = retryableStatus(resp.StatusCode)
+		}
+		if !retry || attempt >= f.MaxRetries {
+			return nil, err
+		}
+		timer := time.NewTimer(f.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errorForTransport(ctx.Err())
+		}
+	}
+}
+
+// newRequest builds the request for an image, with all of the headers the
+// fetcher is set up to send.
+func (f *ProxyFetcher) newRequest(ctx context.Context, fullUrl string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", fullUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := f.UserAgent
+	if userAgent == "" {
+		userAgent = DEFAULT_USER_AGENT
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for name, values := range f.Headers {
+		req.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+	if incoming := slimgfast.RequestHeaderFromContext(ctx); incoming != nil {
+		for _, name := range f.ForwardHeaders {
+			name = http.CanonicalHeaderKey(name)
+			if values, ok := incoming[name]; ok {
+				req.Header[name] = append([]string(nil), values...)
+			}
+		}
+	}
+	if f.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+f.BearerToken)
+	} else if f.Username != "" {
+		req.SetBasicAuth(f.Username, f.Password)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// httpClient returns the client to make requests with, setting it up the
+// first time, from the fetcher's settings if it wasn't given one.
+func (f *ProxyFetcher) httpClient() *http.Client {
+	f.clientOnce.Do(func() {
+		if f.Client != nil {
+			client := *f.Client
+			client.CheckRedirect = f.checkRedirect
+			f.client = &client
+			return
+		}
+		connectTimeout := durationOrDefault(f.ConnectTimeout, DEFAULT_CONNECT_TIMEOUT)
+		maxIdleConns := f.MaxIdleConns
+		if maxIdleConns == 0 {
+			maxIdleConns = DEFAULT_MAX_IDLE_CONNS
+		}
+		dialer := &net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+			Control:   f.dialControl,
+		}
+		proxy := http.ProxyFromEnvironment
+		if f.dialControl != nil {
+			// Through a proxy, the address dialed is the proxy's, not the
+			// server's, so it couldn't be vetted.
+			proxy = nil
+		}
+		f.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 proxy,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   connectTimeout,
+				ResponseHeaderTimeout: durationOrDefault(f.ReadTimeout, DEFAULT_READ_TIMEOUT),
+				MaxIdleConns:          maxIdleConns,
+				MaxIdleConnsPerHost:   maxIdleConns,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			CheckRedirect: f.checkRedirect,
+		}
+	})
+	return f.client
+}
+
+// checkRedirect decides whether to follow a redirect.  Only so many are
+// followed, and only to the same host as the original request, or one of
+// RedirectHosts.  Redirects from HTTPS to plain HTTP are never followed.
+func (f *ProxyFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := f.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DEFAULT_MAX_REDIRECTS
+	}
+	if len(via) > maxRedirects {
+		return slimgfast.NewError(
+			slimgfast.ErrUpstreamUnavailable,
+			fmt.Errorf("Too many redirects (the limit is %d)", maxRedirects),
+		)
+	}
+	original := via[0].URL
+	if req.URL.Scheme != "https" && (req.URL.Scheme != "http" || original.Scheme == "https") {
+		return slimgfast.NewError(
+			slimgfast.ErrForbidden,
+			errors.New("Redirect to a "+req.URL.Scheme+" URL not allowed"),
+		)
+	}
+	host := req.URL.Hostname()
+	sameHost := strings.EqualFold(host, original.Hostname())
+	if !sameHost && !hostAllowed(host, f.RedirectHosts) && !hostAllowed(host, f.originHosts) {
+		return slimgfast.NewError(
+			slimgfast.ErrForbidden,
+			errors.New("Redirect to "+host+" not allowed"),
+		)
+	}
 	return nil
 }
+
+// backoff works out how long to wait before a retry, with jitter.
+func (f *ProxyFetcher) backoff(attempt int) time.Duration {
+	backoff := f.RetryBackoff
+	if backoff <= 0 {
+		backoff = DEFAULT_RETRY_BACKOFF
+	}
+	for i := 0; i < attempt && backoff < MAX_RETRY_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_RETRY_BACKOFF {
+		backoff = MAX_RETRY_BACKOFF
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// timeoutBody is a response body that has to be read within a time limit.
+// Once the limit is up, the request is cancelled and reads fail with
+// ErrTimeout.  Closing it cancels the request too.
+type timeoutBody struct {
+	body     io.ReadCloser
+	timer    *time.Timer
+	timedOut int32
+	cancel   context.CancelFunc
+}
+
+func newTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *timeoutBody {
+	b := &timeoutBody{body: body, cancel: cancel}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&b.timedOut, 1)
+			cancel()
+		})
+	}
+	return b
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		err = slimgfast.NewError(slimgfast.ErrTimeout, errors.New("Timed out reading the image"))
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+// retryableStatus reports whether a request that got the given status back
+// is worth trying again.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// sourceInfoFromResponse pulls what it can about the source image out of the
+// response headers.
+func sourceInfoFromResponse(resp *http.Response) *slimgfast.SourceInfo {
+	info := &slimgfast.SourceInfo{}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
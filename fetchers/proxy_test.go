@@ -0,0 +1,285 @@
+package fetchers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ericflo/slimgfast"
+	"github.com/golang/groupcache"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPNG returns a tiny PNG image.
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestProxyFetcherHeaders(t *testing.T) {
+	img := testPNG(t)
+	var mut sync.Mutex
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		received = r.Header
+		mut.Unlock()
+		w.Write(img)
+	}))
+	defer server.Close()
+	lastHeader := func() http.Header {
+		mut.Lock()
+		defer mut.Unlock()
+		return received
+	}
+
+	fetcher := &ProxyFetcher{
+		ProxyUrlPrefix: server.URL,
+		Headers:        http.Header{"X-Origin-Key": {"static"}},
+		ForwardHeaders: []string{"accept-language", "X-Missing"},
+		BearerToken:    "token",
+	}
+	incoming := http.Header{"Accept-Language": {"de"}, "Cookie": {"secret"}}
+	ctx := slimgfast.WithRequestHeader(context.Background(), incoming)
+	var data []byte
+	if _, err := fetcher.FetchContext(ctx, "/a.jpg", groupcache.AllocatingByteSliceSink(&data)); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"User-Agent":      DEFAULT_USER_AGENT,
+		"X-Origin-Key":    "static",
+		"Accept-Language": "de",
+		"Authorization":   "Bearer token",
+		"Cookie":          "",
+		"X-Missing":       "",
+	}
+	header := lastHeader()
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Errorf("Expected %s to be %q, got: %q", name, value, header.Get(name))
+		}
+	}
+
+	fetcher = &ProxyFetcher{ProxyUrlPrefix: server.URL, UserAgent: "test", Username: "user", Password: "pass"}
+	if _, err := fetcher.FetchContext(context.Background(), "/a.jpg", groupcache.AllocatingByteSliceSink(&data)); err != nil {
+		t.Fatal(err.Error())
+	}
+	header = lastHeader()
+	if header.Get("User-Agent") != "test" || header.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Error("Expected the user agent and basic auth to be sent, got:", header)
+	}
+}
+
+func TestProxyFetcherRetries(t *testing.T) {
+	img := testPNG(t)
+	var mut sync.Mutex
+	attempts := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		attempts[r.URL.Path]++
+		attempt := attempts[r.URL.Path]
+		mut.Unlock()
+		switch {
+		case r.URL.Path == "/missing.jpg":
+			w.WriteHeader(http.StatusNotFound)
+		case attempt <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(img)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		urlPath  string
+		retries  int
+		kind     error
+		attempts int
+	}{
+		{"/flaky.jpg", 2, nil, 3},
+		{"/flakier.jpg", 1, slimgfast.ErrUpstreamUnavailable, 2},
+		{"/missing.jpg", 2, slimgfast.ErrNotFound, 1},
+	}
+	for _, test := range tests {
+		fetcher := &ProxyFetcher{ProxyUrlPrefix: server.URL, MaxRetries: test.retries, RetryBackoff: time.Millisecond}
+		var data []byte
+		_, err := fetcher.FetchContext(context.Background(), test.urlPath, groupcache.AllocatingByteSliceSink(&data))
+		if test.kind == nil && (err != nil || !bytes.Equal(data, img)) {
+			t.Error("Expected", test.urlPath, "to be fetched, got:", err)
+		} else if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Error("Expected", test.urlPath, "to fail with", test.kind, "got:", err)
+		}
+		mut.Lock()
+		if attempts[test.urlPath] != test.attempts {
+			t.Error("Expected", test.attempts, "attempts at", test.urlPath, "got:", attempts[test.urlPath])
+		}
+		mut.Unlock()
+	}
+}
+
+func TestProxyFetcherReadTimeout(t *testing.T) {
+	img := testPNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body.png" {
+			// Send the headers and the start of the image, then stall
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+			w.Write(img[:10])
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	fetcher := &ProxyFetcher{ProxyUrlPrefix: server.URL, ReadTimeout: 50 * time.Millisecond}
+	for _, urlPath := range []string{"/slow-headers.png", "/slow-body.png"} {
+		start := time.Now()
+		var data []byte
+		_, err := fetcher.FetchContext(context.Background(), urlPath, groupcache.AllocatingByteSliceSink(&data))
+		if !errors.Is(err, slimgfast.ErrTimeout) {
+			t.Error("Expected", urlPath, "to time out, got:", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Error("Expected", urlPath, "to give up at the read timeout, took:", elapsed)
+		}
+	}
+}
+
+func TestProxyFetcherBackoff(t *testing.T) {
+	fetcher := &ProxyFetcher{RetryBackoff: 100 * time.Millisecond}
+	for attempt, max := range []time.Duration{100, 200, 400} {
+		max *= time.Millisecond
+		backoff := fetcher.backoff(attempt)
+		if backoff < max/2 || backoff > max {
+			t.Error("Expected retry", attempt, "to wait between", max/2, "and", max, "got:", backoff)
+		}
+	}
+	if backoff := fetcher.backoff(100); backoff > MAX_RETRY_BACKOFF {
+		t.Error("Expected the backoff to be capped, got:", backoff)
+	}
+}
+
+func TestProxyFetcherContentType(t *testing.T) {
+	img := testPNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error.png":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html>Oops</html>"))
+		case "/lying.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("<html>Oops</html>"))
+		case "/binary.png":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(img)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(img)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		urlPath string
+		allowed []string
+		kind    error
+	}{
+		{"/a.png", nil, nil},
+		{"/binary.png", nil, nil},
+		{"/error.png", nil, slimgfast.ErrUpstreamUnavailable},
+		{"/lying.png", nil, slimgfast.ErrUnsupportedImage},
+		{"/a.png", []string{"image/jpeg"}, slimgfast.ErrUpstreamUnavailable},
+		{"/binary.png", []string{"image/*"}, slimgfast.ErrUpstreamUnavailable},
+	}
+	for _, test := range tests {
+		fetcher := &ProxyFetcher{ProxyUrlPrefix: server.URL, AllowedContentTypes: test.allowed}
+		var data []byte
+		_, err := fetcher.FetchContext(context.Background(), test.urlPath, groupcache.AllocatingByteSliceSink(&data))
+		if test.kind == nil && err != nil {
+			t.Error("Expected", test.urlPath, "to be fetched, got:", err)
+		} else if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Error("Expected", test.urlPath, test.allowed, "to fail with", test.kind, "got:", err)
+		}
+	}
+}
+
+func TestProxyFetcherRedirects(t *testing.T) {
+	img := testPNG(t)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img)
+	}))
+	defer other.Close()
+	// The other server is reached by a different host name
+	otherUrl := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hops int
+		if _, err := fmt.Sscanf(r.URL.Path, "/hops/%d", &hops); err == nil && hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/hops/%d", hops-1), http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/away.png" {
+			http.Redirect(w, r, otherUrl+"/a.png", http.StatusFound)
+			return
+		}
+		w.Write(img)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		fetcher *ProxyFetcher
+		urlPath string
+		kind    error
+	}{
+		{&ProxyFetcher{}, "/hops/5", nil},
+		{&ProxyFetcher{}, "/hops/6", slimgfast.ErrUpstreamUnavailable},
+		{&ProxyFetcher{MaxRedirects: 1}, "/hops/1", nil},
+		{&ProxyFetcher{MaxRedirects: 1}, "/hops/2", slimgfast.ErrUpstreamUnavailable},
+		{&ProxyFetcher{MaxRedirects: -1}, "/hops/1", slimgfast.ErrUpstreamUnavailable},
+		{&ProxyFetcher{}, "/away.png", slimgfast.ErrForbidden},
+		{&ProxyFetcher{RedirectHosts: []string{"LOCALHOST"}}, "/away.png", nil},
+		{&ProxyFetcher{RedirectHosts: []string{"*.localhost"}}, "/away.png", slimgfast.ErrForbidden},
+	}
+	for _, test := range tests {
+		test.fetcher.ProxyUrlPrefix = server.URL
+		var data []byte
+		_, err := test.fetcher.FetchContext(context.Background(), test.urlPath, groupcache.AllocatingByteSliceSink(&data))
+		if test.kind == nil && err != nil {
+			t.Error("Expected", test.urlPath, "to be fetched, got:", err)
+		} else if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Error("Expected", test.urlPath, "to fail with", test.kind, "got:", err)
+		}
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"cdn.example.com", "*.partner.com"}
+	tests := map[string]bool{
+		"cdn.example.com":         true,
+		"CDN.Example.com.":        true,
+		"example.com":             false,
+		"img.partner.com":         true,
+		"a.b.partner.com":         true,
+		"partner.com":             false,
+		"evilpartner.com":         false,
+		"cdn.example.com.evil.io": false,
+	}
+	for host, expected := range tests {
+		if hostAllowed(host, allowed) != expected {
+			t.Error("Expected", host, "allowed to be", expected)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package fetchers
 
 import (
 	"errors"
+	"github.com/ericflo/slimgfast"
 	"github.com/golang/groupcache"
 	"launchpad.net/goamz/aws"
 	"launchpad.net/goamz/s3"
+	"net/http"
 	"strings"
 )
 
@@ -12,6 +14,9 @@ import (
 type S3Fetcher struct {
 	Auth   aws.Auth
 	Region aws.Region
+	// MaxBytes is the largest image that will be fetched.  Zero means
+	// slimgfast.DEFAULT_MAX_SOURCE_BYTES, and less than zero means no limit.
+	MaxBytes int64
 }
 
 // parseURL looks at the request URL path to determine the AWS bucket and
@@ -29,16 +34,42 @@ func parseS3Url(f *S3Fetcher, urlPath string) (string, string, error) {
 // Fetch grabs the image data from the bucket and filename requested by the
 // user.
 func (f *S3Fetcher) Fetch(urlPath string, dest groupcache.Sink) error {
+	_, err := f.FetchInfo(urlPath, dest)
+	return err
+}
+
+// FetchInfo grabs the image data from the bucket and filename requested by
+// the user, and reports the object's Last-Modified time.
+func (f *S3Fetcher) FetchInfo(urlPath string, dest groupcache.Sink) (*slimgfast.SourceInfo, error) {
 	bucketname, filename, err := parseS3Url(f, urlPath)
 	if err != nil {
-		return err
+		return nil, slimgfast.NewError(slimgfast.ErrBadRequest, err)
 	}
 	conn := s3.New(f.Auth, f.Region)
 	bucket := conn.Bucket(bucketname)
-	if data, err := bucket.Get(filename); err != nil {
-		return err
-	} else {
-		dest.SetBytes(data)
+	resp, err := bucket.GetResponse(filename)
+	if s3Err, ok := err.(*s3.Error); ok {
+		return nil, errorForS3(s3Err)
+	} else if err != nil {
+		return nil, errorForTransport(err)
+	}
+	defer resp.Body.Close()
+	data, err := readSource(resp.Body, resp.ContentLength, f.MaxBytes)
+	if err != nil {
+		return nil, errorForTransport(err)
+	}
+	dest.SetBytes(data)
+	return sourceInfoFromResponse(resp), nil
+}
+
+// errorForS3 turns an error response from S3 into a slimgfast error of the
+// right kind.
+func errorForS3(err *s3.Error) error {
+	switch err.StatusCode {
+	case http.StatusNotFound:
+		return slimgfast.NewError(slimgfast.ErrNotFound, err)
+	case http.StatusForbidden:
+		return slimgfast.NewError(slimgfast.ErrForbidden, err)
 	}
-	return nil
+	return slimgfast.NewError(slimgfast.ErrUpstreamUnavailable, err)
 }
@@ -0,0 +1,106 @@
+package slimgfast
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// The output formats that can be selected with the "fm" query parameter.
+const (
+	FORMAT_JPEG = "jpg"
+	FORMAT_PNG  = "png"
+	FORMAT_GIF  = "gif"
+)
+
+// formatContentTypes maps each output format to its Content-Type.
+var formatContentTypes = map[string]string{
+	FORMAT_JPEG: "image/jpeg",
+	FORMAT_PNG:  "image/png",
+	FORMAT_GIF:  "image/gif",
+}
+
+// normalizeFormat turns a format name, either from the "fm" query parameter
+// or from image.Decode, into one of the FORMAT_* constants.
+func normalizeFormat(format string) (string, error) {
+	switch format {
+	case "jpg", "jpeg":
+		return FORMAT_JPEG, nil
+	case "png":
+		return FORMAT_PNG, nil
+	case "gif":
+		return FORMAT_GIF, nil
+	}
+	return "", fmt.Errorf("Unsupported image format: %s", format)
+}
+
+// ContentTypeFor returns the Content-Type that should be served for the given
+// resized image data.  If the request asked for a specific format we already
+// know the answer, otherwise the output matches the source image's format and
+// we sniff it.
+func ContentTypeFor(req *ImageRequest, data []byte) string {
+	if contentType, ok := formatContentTypes[req.Format]; ok {
+		return contentType
+	}
+	return http.DetectContentType(data)
+}
+
+// encodeImage encodes img in the given format, at the given quality if the
+// format supports it.  The source image is used to carry over details that
+// the transformations may have lost, like a GIF's palette.
+func encodeImage(img image.Image, src image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FORMAT_PNG:
+		err = png.Encode(&buf, img)
+	case FORMAT_GIF:
+		err = gif.Encode(&buf, palettize(img, src), nil)
+	default:
+		var opts *jpeg.Options
+		if quality > 0 {
+			opts = &jpeg.Options{Quality: quality}
+		}
+		err = jpeg.Encode(&buf, flatten(img), opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// palettize converts img to a paletted image using the source image's palette,
+// if it has one, so GIFs keep their original colors.  Otherwise the GIF
+// encoder picks a palette itself.
+func palettize(img image.Image, src image.Image) image.Image {
+	if _, ok := img.(*image.Paletted); ok {
+		return img
+	}
+	srcPaletted, ok := src.(*image.Paletted)
+	if !ok {
+		return img
+	}
+	paletted := image.NewPaletted(img.Bounds(), srcPaletted.Palette)
+	draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, img.Bounds().Min)
+	return paletted
+}
+
+// flatten draws images with transparency onto a white background, since JPEG
+// has no alpha channel and would otherwise turn transparent areas black.
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); ok && opaque.Opaque() {
+		return img
+	}
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
@@ -0,0 +1,85 @@
+package slimgfast
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"strings"
+)
+
+// DEFAULT_PREWARM_TOP_SIZES is how many of the most requested sizes each image
+// is prewarmed at by default.
+const DEFAULT_PREWARM_TOP_SIZES = 10
+
+// Prewarm generates the App's most requested sizes of each of the source
+// images at the given paths, so that they're already in the cache by the time
+// anyone asks for them.  The work is done at background priority, so it
+// doesn't get in the way of real requests.  It returns the number of resized
+// images it generated.
+func (app *App) Prewarm(ctx context.Context, paths []string) (int, error) {
+	sizes, err := app.sizeCounter.GetTopSizesByCount(app.PrewarmTopSizes)
+	if err != nil {
+		return 0, err
+	}
+	return app.PrewarmSizes(ctx, paths, sizes)
+}
+
+// PrewarmSizes generates each of the given sizes of each of the source images
+// at the given paths, at background priority.  Failures for one image are
+// logged and skipped, but it gives up as soon as the context is done.  It
+// returns the number of resized images it generated.
+func (app *App) PrewarmSizes(ctx context.Context, paths []string, sizes []Size) (int, error) {
+	ctx = WithPriority(ctx, PRIORITY_BACKGROUND)
+	generated := 0
+	for _, urlPath := range paths {
+		for _, size := range sizes {
+			if err := ctx.Err(); err != nil {
+				return generated, err
+			}
+			req := &ImageRequest{
+				Url:     urlPath,
+				Width:   int(size.Width),
+				Height:  int(size.Height),
+				Quality: app.clampQuality(0),
+			}
+			if req.Width > app.MaxWidth || req.Height > app.MaxHeight {
+				continue
+			}
+			if err := app.setSourceVersion(ctx, req); err != nil {
+				log.Println("Error prewarming", urlPath, size.Key(), err)
+				continue
+			}
+			if _, _, err := app.getImage(ctx, req); err != nil {
+				log.Println("Error prewarming", urlPath, size.Key(), err)
+				continue
+			}
+			generated++
+		}
+	}
+	return generated, nil
+}
+
+// PrewarmUpload prewarms a newly uploaded source image in the background.  It
+// returns right away, so it can be called from an upload handler.
+func (app *App) PrewarmUpload(urlPath string) {
+	go app.Prewarm(context.Background(), []string{urlPath})
+}
+
+// ReadPathList reads a list of source image paths, one per line, for
+// prewarming.  Blank lines and lines starting with # are skipped.
+func ReadPathList(r io.Reader) ([]string, error) {
+	paths := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
@@ -0,0 +1,122 @@
+package slimgfast
+
+import (
+	"context"
+	"github.com/golang/groupcache"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrewarmSizes(t *testing.T) {
+	app := getTestApp(t)
+	paths := []string{"/wide.png", "/missing.png"}
+	sizes := []Size{{Width: 37}, {Height: 19}, {Width: 5000, Height: 10}}
+	generated, err := app.PrewarmSizes(context.Background(), paths, sizes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if generated != 2 {
+		t.Error("Expected 2 prewarmed images, got:", generated)
+	}
+
+	// Requests for the prewarmed sizes shouldn't need to resize anything.
+	loads := app.cache.Stats.Loads.Get()
+	for _, url := range []string{"/wide.png?w=37", "/wide.png?utm_source=x&h=19"} {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusOK {
+			t.Error("Expected a 200 for", url, "got:", w.Code)
+		}
+	}
+	if newLoads := app.cache.Stats.Loads.Get(); newLoads != loads {
+		t.Error("Expected prewarmed images to come from the cache, got loads:", newLoads-loads)
+	}
+}
+
+func TestPrewarmSizesCancelled(t *testing.T) {
+	app := getTestApp(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	generated, err := app.PrewarmSizes(ctx, []string{"/wide.png"}, []Size{{Width: 38}})
+	if err != context.Canceled || generated != 0 {
+		t.Error("Expected prewarming to stop when cancelled, got:", generated, err)
+	}
+}
+
+func TestPrewarmLoadPromotedByLiveRequest(t *testing.T) {
+	data := encodeTestPNG(t, 20, 20)
+	order := &orderTransformer{release: make(chan struct{})}
+	wg := &WorkerGroup{NumWorkers: 1, Transformers: []Transformer{order}}
+	wg.Start()
+	defer wg.Close()
+	fetcher := &testFetcher{images: map[string][]byte{"/a.png": data}}
+	src := NewImageSourceCustomCache(fetcher, testGroupName("slimgfast_test_promote_source"), 1)
+	app := &App{imageSource: src, workerGroup: wg}
+	app.cache = groupcache.NewGroup(
+		testGroupName("slimgfast_test_promote"),
+		1<<20,
+		getCacheGetter(src, wg, &app.loads),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Tie up the only worker, so that the prewarm job has to queue
+	go wg.Resize(ctx, data, &ImageRequest{Width: 1})
+	waitFor(t, "a busy worker", func() bool { return wg.Stats().Busy == 1 })
+	req := &ImageRequest{Url: "/a.png", Width: 10}
+	go app.getImage(WithPriority(ctx, PRIORITY_BACKGROUND), req)
+	waitFor(t, "the prewarm job", func() bool { return wg.Stats().BackgroundQueueDepth == 1 })
+
+	// A live request for the same image joins the prewarm's load, which
+	// moves it to the interactive queue
+	live := make(chan error, 1)
+	go func() {
+		_, _, err := app.getImage(ctx, req)
+		live <- err
+	}()
+	waitFor(t, "the prewarm job to be promoted", func() bool {
+		stats := wg.Stats()
+		return stats.QueueDepth == 1 && stats.BackgroundQueueDepth == 0
+	})
+
+	// Background jobs get no share of the workers, and interactive work keeps
+	// arriving, but the live request still gets its image
+	stop := make(chan struct{})
+	var feeders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		feeders.Add(1)
+		go func() {
+			defer feeders.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				wg.Resize(ctx, data, &ImageRequest{Width: 2})
+			}
+		}()
+	}
+	close(order.release)
+	if err := <-live; err != nil {
+		t.Error("Expected the live request to be served, got:", err)
+	}
+	close(stop)
+	feeders.Wait()
+}
+
+func TestReadPathList(t *testing.T) {
+	list := "/a.jpg\n\n# Some comment\n  /b/c.png  \n"
+	paths, err := ReadPathList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := []string{"/a.jpg", "/b/c.png"}; !reflect.DeepEqual(paths, expected) {
+		t.Error("Expected", expected, "got:", paths)
+	}
+}
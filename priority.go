@@ -0,0 +1,142 @@
+package slimgfast
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority is how urgently a job needs doing.  Workers always prefer
+// interactive jobs, which have someone waiting on them, over background jobs
+// like prewarming the cache.
+type Priority int
+
+const (
+	PRIORITY_INTERACTIVE Priority = iota
+	PRIORITY_BACKGROUND
+)
+
+// DEFAULT_BACKGROUND_SHARE is how often a worker takes a background job over
+// an interactive one by default, so that background work can't be starved
+// entirely: one job in every DEFAULT_BACKGROUND_SHARE.
+const DEFAULT_BACKGROUND_SHARE = 10
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of the context which marks any jobs done on its
+// behalf with the given priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority set on the context with
+// WithPriority, or PRIORITY_INTERACTIVE if there isn't one.
+func PriorityFromContext(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PRIORITY_INTERACTIVE
+}
+
+type promotionKey struct{}
+
+// withPromotion returns a copy of the context carrying a channel that is
+// closed if the background work done on its behalf should be promoted to
+// interactive priority.
+func withPromotion(ctx context.Context, promoted <-chan struct{}) context.Context {
+	return context.WithValue(ctx, promotionKey{}, promoted)
+}
+
+// promotionFromContext returns the channel set on the context with
+// withPromotion, or nil, which is never ready, if there isn't one.
+func promotionFromContext(ctx context.Context) <-chan struct{} {
+	promoted, _ := ctx.Value(promotionKey{}).(<-chan struct{})
+	return promoted
+}
+
+// sharedLoads keeps track of the cache keys that interactive callers are
+// waiting on.  groupcache runs a load under the context of whoever asked
+// first, so when that was background work like prewarming, the interactive
+// callers who join it would otherwise wait at background priority.
+type sharedLoads struct {
+	mut   sync.Mutex
+	loads map[string]*sharedLoad
+}
+
+// sharedLoad is the state of one cache key in sharedLoads.
+type sharedLoad struct {
+	// waiting is the number of interactive callers waiting on the key.
+	waiting int
+	// loading is whether a background load of the key is running, and
+	// promoted is closed once it should be promoted.
+	loading  bool
+	promoted chan struct{}
+}
+
+// get returns the state of a key, creating it if needs be.  The caller must
+// hold the lock.
+func (s *sharedLoads) get(key string) *sharedLoad {
+	if s.loads == nil {
+		s.loads = map[string]*sharedLoad{}
+	}
+	load, ok := s.loads[key]
+	if !ok {
+		load = &sharedLoad{promoted: make(chan struct{})}
+		s.loads[key] = load
+	}
+	return load
+}
+
+// release forgets a key once nothing is waiting on or loading it.  The caller
+// must hold the lock.
+func (s *sharedLoads) release(key string, load *sharedLoad) {
+	if load.waiting == 0 && !load.loading {
+		delete(s.loads, key)
+	}
+}
+
+// promote closes the key's promotion channel if an interactive caller is
+// waiting on a background load of it.  The caller must hold the lock.
+func (load *sharedLoad) promote() {
+	if load.waiting == 0 || !load.loading {
+		return
+	}
+	select {
+	case <-load.promoted:
+	default:
+		close(load.promoted)
+	}
+}
+
+// wait notes that an interactive caller is waiting on the key, promoting any
+// background load of it.  The returned function must be called once the
+// caller has stopped waiting.
+func (s *sharedLoads) wait(key string) func() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	load := s.get(key)
+	load.waiting++
+	load.promote()
+	return func() {
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		load.waiting--
+		s.release(key, load)
+	}
+}
+
+// startBackground notes that a background load of the key has started.  It
+// returns a channel that's closed if an interactive caller waits on the key,
+// and a function that must be called once the load is done.
+func (s *sharedLoads) startBackground(key string) (<-chan struct{}, func()) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	load := s.get(key)
+	load.loading = true
+	load.promote()
+	return load.promoted, func() {
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		load.loading = false
+		s.release(key, load)
+	}
+}
@@ -1,13 +1,40 @@
 package slimgfast
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"image/color"
 	"net/url"
 	"strconv"
 	"strings"
 )
 
+// The ways an image can be fit into the requested dimensions, selected with
+// the "fit" query parameter.
+const (
+	// FIT_CLIP resizes the image to fit within the requested dimensions while
+	// preserving its aspect ratio.  This is the default.
+	FIT_CLIP = "clip"
+	// FIT_CROP resizes the image to cover the requested dimensions while
+	// preserving its aspect ratio, and crops off whatever hangs over the edges.
+	FIT_CROP = "crop"
+	// FIT_SCALE stretches the image to exactly the requested dimensions,
+	// ignoring its aspect ratio.
+	FIT_SCALE = "scale"
+	// FIT_MAX behaves like FIT_CLIP, except it will never upscale an image.
+	FIT_MAX = "max"
+	// FIT_FILL behaves like FIT_CLIP, but pads the result out to exactly the
+	// requested dimensions using the background color from the "bg" query
+	// parameter.
+	FIT_FILL = "fill"
+)
+
+// DEFAULT_BACKGROUND is the background color used by FIT_FILL when the
+// request doesn't specify one.
+const DEFAULT_BACKGROUND = "ffffff"
+
 // ImageRequest captures information about which file the user wants to have
 // transformed and served, and what transformations the user would like to
 // make with it.
@@ -16,6 +43,19 @@ type ImageRequest struct {
 	Width  int
 	Height int
 	Fit    string
+	// Background is the hex color that FIT_FILL pads the image with, in RGB,
+	// RRGGBB or AARRGGBB form.
+	Background string
+	// Format is the output format, one of the FORMAT_* constants.  If empty,
+	// the output is encoded in the same format as the source image.
+	Format string
+	// Quality is the JPEG encoding quality, from 1 to 100.  Zero means the
+	// App's default quality, and it's always zero for PNG and GIF output.
+	Quality int
+	// SourceVersion is the version of the source image to resize, from
+	// SourceInfo.Version, if it's known.  It's part of the cache key, so
+	// that changed source images get resized again.
+	SourceVersion string
 }
 
 // ImageRequestFromURLString parses a URL string and constructs an ImageRequest
@@ -26,7 +66,28 @@ func ImageRequestFromURLString(rawUrl string) (*ImageRequest, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The full URL of the source image can be given in the query instead of
+	// the path, and it's moved into the path, which is what gets fetched.
+	if sourceUrl := parsedUrl.Query().Get(SOURCE_URL_PARAM); sourceUrl != "" && (parsedUrl.Path == "/" || parsedUrl.Path == "") {
+		parsedUrl.Path = SourcePath(sourceUrl)
+		parsedUrl.RawPath = ""
+		req.Url = parsedUrl.String()
+	}
 	req.Fit = parsedUrl.Query().Get("fit")
+	switch req.Fit {
+	case "", FIT_CLIP, FIT_CROP, FIT_SCALE, FIT_MAX, FIT_FILL:
+	default:
+		return nil, fmt.Errorf("Unknown fit requested: %s", req.Fit)
+	}
+	if fm := parsedUrl.Query().Get("fm"); fm != "" {
+		if req.Format, err = normalizeFormat(fm); err != nil {
+			return nil, err
+		}
+	}
+	req.Background = parsedUrl.Query().Get("bg")
+	if _, err := parseHexColor(req.Background); err != nil {
+		return nil, err
+	}
 	// Purposely ignore the strcon errors here, if they're empty strings we'll
 	// notice that later and serve the image at its original size.
 	w := parsedUrl.Query().Get("w")
@@ -36,6 +97,11 @@ func ImageRequestFromURLString(rawUrl string) (*ImageRequest, error) {
 	}
 	req.Width, _ = strconv.Atoi(w)
 	req.Height, _ = strconv.Atoi(h)
+	q := parsedUrl.Query().Get("q")
+	if strings.Contains(q, "-") {
+		return nil, errors.New("Cannot request a negative quality.")
+	}
+	req.Quality, _ = strconv.Atoi(q)
 	return &req, nil
 }
 
@@ -48,9 +114,15 @@ func ImageRequestFromCacheKey(cacheKey string) (*ImageRequest, error) {
 }
 
 // CacheKey generates a cache key that encodes all of the information about
-// this ImageRequest.
+// this ImageRequest.  The query string is left out of the URL, since
+// everything that matters in it has already been parsed out, so requests
+// which only differ in the order of their parameters share a cache key.
 func (req *ImageRequest) CacheKey() (string, error) {
-	b, err := json.Marshal(req)
+	keyReq := *req
+	if parsedUrl, err := url.Parse(req.Url); err == nil {
+		keyReq.Url = parsedUrl.EscapedPath()
+	}
+	b, err := json.Marshal(&keyReq)
 	if err != nil {
 		return "", err
 	}
@@ -58,13 +130,60 @@ func (req *ImageRequest) CacheKey() (string, error) {
 }
 
 // Size is a convenience function for getting a *Size out of the parsed width
-// and height ImageRequest members.
+// and height ImageRequest members.  Requests which only specify one of the
+// dimensions get a Size with the other dimension left as zero.
 func (req *ImageRequest) Size() (*Size, error) {
-	if req.Width == 0 || req.Width == -1 {
-		return nil, errors.New("Image does not have a specified width")
+	if req.Width <= 0 && req.Height <= 0 {
+		return nil, errors.New("Image does not have a specified width or height")
+	}
+	size := &Size{}
+	if req.Width > 0 {
+		size.Width = uint(req.Width)
+	}
+	if req.Height > 0 {
+		size.Height = uint(req.Height)
+	}
+	return size, nil
+}
+
+// Dimensions works out the final width and height of the image, given the
+// dimensions of the source image.  If only one of Width or Height was
+// requested, the other is derived from the source image's aspect ratio.  If
+// neither was requested, the source dimensions are returned unchanged.
+func (req *ImageRequest) Dimensions(srcWidth, srcHeight int) (int, int) {
+	width, height := req.Width, req.Height
+	switch {
+	case width == 0 && height == 0:
+		return srcWidth, srcHeight
+	case srcWidth == 0 || srcHeight == 0:
+		return width, height
+	case height == 0:
+		height = maxInt(1, roundDiv(srcHeight*width, srcWidth))
+	case width == 0:
+		width = maxInt(1, roundDiv(srcWidth*height, srcHeight))
+	}
+	return width, height
+}
+
+// parseHexColor parses a hex color of the form RGB, RRGGBB or AARRGGBB.  An
+// empty string is parsed as DEFAULT_BACKGROUND.
+func parseHexColor(hexColor string) (color.Color, error) {
+	if hexColor == "" {
+		hexColor = DEFAULT_BACKGROUND
+	}
+	h := strings.TrimPrefix(hexColor, "#")
+	if len(h) == 3 {
+		h = strings.Repeat(h[0:1], 2) +
+			strings.Repeat(h[1:2], 2) +
+			strings.Repeat(h[2:3], 2)
+	}
+	if len(h) == 6 {
+		h = "ff" + h
 	}
-	if req.Height == 0 || req.Width == -1 {
-		return nil, errors.New("Image does not have a specified height")
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("Invalid background color: %s", hexColor)
 	}
-	return &Size{Width: uint(req.Width), Height: uint(req.Height)}, nil
+	// color.NRGBA is not premultiplied, which matches how people write colors.
+	return color.NRGBA{R: b[1], G: b[2], B: b[3], A: b[0]}, nil
 }
@@ -0,0 +1,96 @@
+package slimgfast
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	oldKey, newKey := []byte("old secret"), []byte("new secret")
+	app := &App{SigningKeys: [][]byte{newKey, oldKey}}
+	signed, err := SignURL(newKey, "/a%20b.jpg?w=300&h=200", time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rotated, _ := SignURL(oldKey, "/a%20b.jpg?w=300&h=200", time.Time{})
+	expiring, _ := SignURL(newKey, "/a.jpg?w=300", time.Now().Add(time.Hour))
+	expired, _ := SignURL(newKey, "/a.jpg?w=300", time.Now().Add(-time.Hour))
+	unknownKey, _ := SignURL([]byte("someone else"), "/a.jpg?w=300", time.Time{})
+
+	// The same parameters in a different order are still signed
+	parsed, _ := url.Parse(signed)
+	reordered := parsed.EscapedPath() + "?s=" + parsed.Query().Get("s") + "&w=300&h=200"
+
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{signed, true},
+		{reordered, true},
+		{rotated, true},
+		{expiring, true},
+		{expired, false},
+		{unknownKey, false},
+		{"/a.jpg?w=300", false},
+		{strings.Replace(signed, "w=300", "w=301", 1), false},
+		{strings.Replace(signed, "%20b", "%20c", 1), false},
+		{signed + "&fit=crop", false},
+		{strings.Replace(expiring, "expires=", "expires=9", 1), false},
+	}
+	for _, test := range tests {
+		err := app.verifySignature(httptest.NewRequest("GET", test.url, nil))
+		if test.valid && err != nil {
+			t.Error("Expected", test.url, "to be valid, got:", err)
+		}
+		if !test.valid && StatusForError(err) != http.StatusForbidden {
+			t.Error("Expected", test.url, "to be forbidden, got:", err)
+		}
+	}
+
+	app.SigningKeys = nil
+	if err := app.verifySignature(httptest.NewRequest("GET", "/a.jpg?w=300", nil)); err != nil {
+		t.Error("Expected unsigned URLs without signing keys, got:", err)
+	}
+}
+
+func TestServeHTTPSignedURLs(t *testing.T) {
+	app := getTestApp(t)
+	key := []byte("secret")
+	app.SigningKeys = [][]byte{key}
+	defer func() { app.SigningKeys = nil }()
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/wide.png?w=20", nil))
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected a 403 for an unsigned URL, got:", w.Code)
+	}
+	signed, _ := SignURL(key, "/wide.png?w=20", time.Time{})
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", signed, nil))
+	if w.Code != http.StatusOK {
+		t.Error("Expected a 200 for a signed URL, got:", w.Code)
+	}
+}
+
+func TestSizePolicyRedirectIsSigned(t *testing.T) {
+	key := []byte("secret")
+	app := &App{
+		SigningKeys:  [][]byte{key},
+		SizePolicy:   SIZE_POLICY_REDIRECT,
+		AllowedSizes: []Size{{Width: 300}},
+	}
+	signed, _ := SignURL(key, "/a.jpg?w=250", time.Time{})
+	req, _ := ImageRequestFromURLString(signed)
+	w := httptest.NewRecorder()
+	if !app.enforceSizePolicy(w, httptest.NewRequest("GET", signed, nil), req) {
+		t.Fatal("Expected a redirect")
+	}
+	location := w.Header().Get("Location")
+	if err := app.verifySignature(httptest.NewRequest("GET", location, nil)); err != nil {
+		t.Error("Expected the redirect to be signed, got:", location, err)
+	}
+}
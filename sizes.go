@@ -5,120 +5,285 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-// Size is a Width and a Height
+// Size is a Width and a Height.  Either one (but not both) may be zero, which
+// means that the dimension was left out of the request and derived from the
+// aspect ratio of the source image.
 type Size struct {
 	Width  uint
 	Height uint
 }
 
+// SIZE_WILDCARD stands in for a missing dimension in a size key, so a request
+// for only a width of 300 is counted as "300x*".
+const SIZE_WILDCARD = "*"
+
+// MAX_DECAY_FACTOR is how far the time-decayed weights are allowed to grow
+// before they're rebased on the current time.
+const MAX_DECAY_FACTOR = 1 << 60
+
+// MAX_DECAY_HALF_LIVES caps how many half-lives the weights are decayed by at
+// once, so that a long idle spell can't overflow the decay factor.  Anything
+// that old has decayed to nothing anyway.
+const MAX_DECAY_HALF_LIVES = 1000
+
 // SizeFile is a struct that is used to serialize the aggregated Size counts
-// to a JSON file.
+// to a JSON file.  If time decay is on, the decayed weights are saved along
+// with the raw counts, and the half-life they were decayed with.
 type SizeFile struct {
-	Counts map[string]uint
+	Counts     map[string]uint
+	Weights    map[string]float64
+	DecayEpoch time.Time
+	HalfLife   time.Duration
 }
 
 // SizeCounter keeps track of how many times a certain size was requested, and
 // persists this information to disk on a periodic basis.
 type SizeCounter struct {
 	filename string
+	// fileGood is whether the file on disk is known to be good, and so is
+	// worth keeping as the backup when it's replaced.
+	fileGood bool
 	counts   map[string]uint
-	done     chan struct{}
-	mut      *sync.RWMutex
+	// weights are the time-decayed counts, when a half-life is set.  To avoid
+	// decaying every weight on every request, they're kept relative to
+	// decayEpoch: a request at time t adds decayFactor(t) rather than 1, and
+	// the weights are divided by decayFactor(now) when they're read.
+	weights    map[string]float64
+	decayEpoch time.Time
+	halfLife   time.Duration
+	// peers are the base URLs of the other nodes in the cluster, and
+	// peerCounts are the latest size counts pulled from each of them.
+	peers      []string
+	peerCounts map[string]map[string]float64
+	done       chan struct{}
+	mut        *sync.RWMutex
+}
+
+// SizeCount is a size along with how many times it's been requested.  With
+// time decay on, the count is the decayed count, so it needn't be whole.
+type SizeCount struct {
+	Size  Size
+	Count float64
 }
 
 // SizeFromKey takes a string of the form WIDTHxHEIGHT and parses it into a
-// Size struct.
+// Size struct.  One of WIDTH or HEIGHT may be SIZE_WILDCARD.
 func SizeFromKey(key string) (Size, error) {
 	var s Size
 	splitKey := strings.Split(key, "x")
-	if width, err := strconv.Atoi(splitKey[0]); err == nil {
-		if width < 1 {
-			return s, fmt.Errorf("Got a key with an invalid width: %s", key)
-		}
-		s.Width = uint(width)
-	} else {
-		return s, err
+	if len(splitKey) != 2 {
+		return s, fmt.Errorf("Got a malformed key: %s", key)
 	}
-	if height, err := strconv.Atoi(splitKey[1]); err == nil {
-		if height < 1 {
-			return s, fmt.Errorf("Got a key with an invalid height: %s", key)
-		}
-		s.Height = uint(height)
-	} else {
-		return s, err
+	width, err := parseSizeKeyDimension(splitKey[0])
+	if err != nil {
+		return s, fmt.Errorf("Got a key with an invalid width: %s", key)
+	}
+	height, err := parseSizeKeyDimension(splitKey[1])
+	if err != nil {
+		return s, fmt.Errorf("Got a key with an invalid height: %s", key)
 	}
+	if width == 0 && height == 0 {
+		return s, fmt.Errorf("Got a key with no width or height: %s", key)
+	}
+	s.Width = width
+	s.Height = height
 	return s, nil
 }
 
+// parseSizeKeyDimension parses one half of a size key, returning zero for
+// SIZE_WILDCARD.
+func parseSizeKeyDimension(dim string) (uint, error) {
+	if dim == SIZE_WILDCARD {
+		return 0, nil
+	}
+	val, err := strconv.Atoi(dim)
+	if err != nil {
+		return 0, err
+	}
+	if val < 1 {
+		return 0, fmt.Errorf("Invalid dimension: %d", val)
+	}
+	return uint(val), nil
+}
+
 // Key takes the current Size object's Width and Height and generates a string
-// of the form WIDTHxHEIGHT
+// of the form WIDTHxHEIGHT, using SIZE_WILDCARD for a missing dimension.
 func (size Size) Key() string {
-	return fmt.Sprintf("%dx%d", size.Width, size.Height)
+	width, height := SIZE_WILDCARD, SIZE_WILDCARD
+	if size.Width != 0 {
+		width = strconv.FormatUint(uint64(size.Width), 10)
+	}
+	if size.Height != 0 {
+		height = strconv.FormatUint(uint64(size.Height), 10)
+	}
+	return width + "x" + height
 }
 
 // NewSizeCounter initializes a *SizeCounter struct, loads in, and parses the
-// persisted sizes.
+// persisted sizes.  If the sizes file is missing or can't be read, the backup
+// of the last good one is used instead, and failing that the counter starts
+// out empty.
 func NewSizeCounter(filename string) (*SizeCounter, error) {
-	counts, err := getCountsFromFilename(filename)
+	sizeFile, err := getSizeFileFromFilename(filename)
+	fileGood := err == nil
 	if err != nil {
-		return nil, err
+		if !os.IsNotExist(err) {
+			log.Print("Could not load sizes file, trying the backup: " + err.Error())
+		}
+		sizeFile, err = getSizeFileFromFilename(backupFilename(filename))
+		if err != nil && !os.IsNotExist(err) {
+			log.Print("Could not load backup sizes file, starting over: " + err.Error())
+		}
+	}
+	if err != nil {
+		sizeFile = &SizeFile{}
+	}
+	if sizeFile.Counts == nil {
+		sizeFile.Counts = make(map[string]uint)
 	}
 	mut := &sync.RWMutex{}
-	return &SizeCounter{
+	counter := &SizeCounter{
 		filename: filename,
+		fileGood: fileGood,
 		done:     make(chan struct{}),
-		counts:   counts,
+		counts:   sizeFile.Counts,
 		mut:      mut,
-	}, nil
+	}
+	if sizeFile.Weights != nil && sizeFile.HalfLife > 0 {
+		// Decay the weights up to now with the half-life they were saved
+		// with, so that they can be read against whatever half-life is set.
+		// Weights saved without their half-life can't be, so decay starts
+		// over from the raw counts instead.
+		counter.weights = sizeFile.Weights
+		counter.decayEpoch = sizeFile.DecayEpoch
+		counter.rebase(time.Now(), sizeFile.HalfLife)
+	}
+	return counter, nil
 }
 
-// getCountsFromFilename loads in and parses the persisted sizes stored at the
-// specified filename.
-func getCountsFromFilename(filename string) (map[string]uint, error) {
-	sizes := make(map[string]uint)
-
-	// If there's no file, then there's nothing to read
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return sizes, nil
-	}
+// backupFilename is where the last good copy of a sizes file is kept.
+func backupFilename(filename string) string {
+	return filename + ".bak"
+}
 
-	// Open the file
+// getSizeFileFromFilename loads in and parses the persisted sizes stored at
+// the specified filename.
+func getSizeFileFromFilename(filename string) (*SizeFile, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Print("Could not open file: " + err.Error())
-		return sizes, err
+		return nil, err
 	}
 	defer file.Close()
 
 	// Decode the json
+	sizeFile := &SizeFile{}
 	decoder := json.NewDecoder(file)
-	var sizeFile SizeFile
-	if err := decoder.Decode(&sizeFile); err != nil {
-		log.Fatal(err)
+	if err := decoder.Decode(sizeFile); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", filename, err)
 	}
-
-	return sizeFile.Counts, nil
+	return sizeFile, nil
 }
 
 // saveFile serializes and persists the aggregated size stats to the filesystem.
 func saveFile(counter *SizeCounter) error {
 	counter.mut.RLock()
-	defer counter.mut.RUnlock()
-	bytes, err := json.Marshal(SizeFile{Counts: counter.counts})
+	sizeFile := SizeFile{Counts: counter.counts}
+	if counter.halfLife > 0 {
+		// The weights are only kept up to date while time decay is on
+		sizeFile.Weights = counter.weights
+		sizeFile.DecayEpoch = counter.decayEpoch
+		sizeFile.HalfLife = counter.halfLife
+	}
+	bytes, err := json.Marshal(sizeFile)
+	counter.mut.RUnlock()
 	if err != nil {
 		return err
 	}
-	if err = ioutil.WriteFile(counter.filename, bytes, 0666); err != nil {
+	if err = writeSizeFile(counter.filename, bytes, counter.fileGood); err != nil {
 		log.Print("Error writing out sizes file: " + err.Error())
 		return err
 	}
+	counter.fileGood = true
+	return nil
+}
+
+// writeSizeFile replaces the sizes file with the given data without ever
+// leaving a partly written file behind.  The data is written to a temporary
+// file and synced to disk, the old file is copied to the backup if backup is
+// true, and then the new file is renamed into place.  The old file is never
+// moved out of the way, so there's always a sizes file to load.
+func writeSizeFile(filename string, data []byte, backup bool) error {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if backup {
+		if err = backupSizeFile(filename); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Make sure the renames themselves are on disk.  Not every platform can
+	// sync a directory, so this is best effort.
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
+
+// backupSizeFile replaces the backup with the current sizes file.  The backup
+// is hard linked, or copied if that isn't possible, to a temporary name and
+// then renamed into place, so there's always a whole backup.
+func backupSizeFile(filename string) error {
+	tmpName := backupFilename(filename) + ".tmp"
+	os.Remove(tmpName)
+	if err := os.Link(filename, tmpName); err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(tmpName, data, 0644); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	if err := os.Rename(tmpName, backupFilename(filename)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
 	return nil
 }
 
@@ -150,9 +315,129 @@ func (counter *SizeCounter) CountSize(size *Size) {
 	} else {
 		counter.counts[key] = 1
 	}
+	if counter.halfLife > 0 {
+		counter.addWeight(key, time.Now())
+	}
 	return
 }
 
+// SetHalfLife turns on exponential time decay of the counts used to rank
+// sizes, so that a request counts half as much after each halfLife has
+// passed.  That way sizes that have fallen out of use fade out of the
+// rankings.  Zero or less turns time decay off, and ranks sizes by their raw
+// counts.
+func (counter *SizeCounter) SetHalfLife(halfLife time.Duration) {
+	counter.mut.Lock()
+	defer counter.mut.Unlock()
+	if halfLife <= 0 {
+		counter.halfLife = 0
+		counter.weights = nil
+		return
+	}
+	if counter.weights == nil {
+		// Start decaying from the raw counts
+		counter.decayEpoch = time.Now()
+		counter.weights = make(map[string]float64, len(counter.counts))
+		for key, count := range counter.counts {
+			counter.weights[key] = float64(count)
+		}
+	} else if counter.halfLife > 0 {
+		// The weights so far were decayed with the old half-life
+		counter.rebase(time.Now(), counter.halfLife)
+	}
+	counter.halfLife = halfLife
+}
+
+// decayFactor is how much a request at the given time counts for, relative
+// to a request at the decay epoch.
+func (counter *SizeCounter) decayFactor(now time.Time) float64 {
+	return decayFactor(counter.decayEpoch, now, counter.halfLife)
+}
+
+// decayFactor is how much a request at now counts for relative to one at the
+// epoch, with the given half-life.  Times before the epoch count the same as
+// the epoch, and the factor is capped at MAX_DECAY_HALF_LIVES half-lives.
+func decayFactor(epoch time.Time, now time.Time, halfLife time.Duration) float64 {
+	halfLives := float64(now.Sub(epoch)) / float64(halfLife)
+	halfLives = math.Max(0, math.Min(halfLives, MAX_DECAY_HALF_LIVES))
+	return math.Exp2(halfLives)
+}
+
+// rebase decays the weights up to the given time with the given half-life,
+// and makes that time the decay epoch.  The counter must be write locked.
+func (counter *SizeCounter) rebase(now time.Time, halfLife time.Duration) {
+	factor := decayFactor(counter.decayEpoch, now, halfLife)
+	for key, weight := range counter.weights {
+		counter.weights[key] = weight / factor
+	}
+	counter.decayEpoch = now
+}
+
+// addWeight adds a request at the given time to the decayed weight of a size.
+// The counter must be write locked.
+func (counter *SizeCounter) addWeight(key string, now time.Time) {
+	factor := counter.decayFactor(now)
+	if factor > MAX_DECAY_FACTOR {
+		// Rebase the weights on the current time before they overflow
+		counter.rebase(now, counter.halfLife)
+		factor = 1
+	}
+	counter.weights[key] += factor
+}
+
+// scores returns the count that each size key is ranked by: the decayed
+// weight as of now if time decay is on, or the raw count otherwise.  The
+// counter must be read locked.
+func (counter *SizeCounter) scores(now time.Time) map[string]float64 {
+	scores := make(map[string]float64, len(counter.counts))
+	if counter.halfLife > 0 {
+		factor := counter.decayFactor(now)
+		for key, weight := range counter.weights {
+			scores[key] = weight / factor
+		}
+	} else {
+		for key, count := range counter.counts {
+			scores[key] = float64(count)
+		}
+	}
+	return scores
+}
+
+// GetRankedSizes returns every size that's been requested along with its
+// count, most requested first.  If the counter has peers, the counts are
+// cluster-wide.  Sizes with the same count are ordered by key, so that the
+// ranking is stable.
+func (counter *SizeCounter) GetRankedSizes() ([]SizeCount, error) {
+	counter.mut.RLock()
+	scores := counter.clusterScores(time.Now())
+	counter.mut.RUnlock()
+	return rankSizes(scores)
+}
+
+// rankSizes turns a map of size keys to counts into a list of sizes, most
+// requested first.
+func rankSizes(scores map[string]float64) ([]SizeCount, error) {
+	keys := make([]string, 0, len(scores))
+	for key := range scores {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	ranked := make([]SizeCount, 0, len(keys))
+	for _, key := range keys {
+		size, err := SizeFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		ranked = append(ranked, SizeCount{Size: size, Count: scores[key]})
+	}
+	return ranked, nil
+}
+
 // GetAllSizes gets a list of all the sizes that we've seen.
 func (counter *SizeCounter) GetAllSizes() ([]Size, error) {
 	counter.mut.RLock()
@@ -168,30 +453,46 @@ func (counter *SizeCounter) GetAllSizes() ([]Size, error) {
 	return sizes, nil
 }
 
-// GetTopSizesByCount gets a list of all the sizes who have been requested at
-// least `count` times.
+// GetTopSizesByCount gets the `count` most requested sizes, most requested
+// first.
 func (counter *SizeCounter) GetTopSizesByCount(count uint) ([]Size, error) {
-	// TODO: Sort first or something, this is not correct right now, it'll pick random values
-	counter.mut.RLock()
-	defer counter.mut.RUnlock()
+	ranked, err := counter.GetRankedSizes()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]Size, 0, count)
+	for i := 0; i < len(ranked) && uint(i) < count; i++ {
+		sizes = append(sizes, ranked[i].Size)
+	}
+	return sizes, nil
+}
+
+// GetTopSizesByPercentage gets the smallest set of sizes which together make
+// up at least `percentage` percent of all requests, most requested first.
+func (counter *SizeCounter) GetTopSizesByPercentage(percentage float64) ([]Size, error) {
+	if percentage <= 0 || percentage > 100 {
+		return nil, fmt.Errorf("Percentage must be over 0 and at most 100: %v", percentage)
+	}
+	ranked, err := counter.GetRankedSizes()
+	if err != nil {
+		return nil, err
+	}
+	total := 0.0
+	for _, sizeCount := range ranked {
+		total += sizeCount.Count
+	}
 	sizes := make([]Size, 0)
-	i := 0
-	for key := range counter.counts {
-		if uint(i) == count {
-			return sizes, nil
+	covered := 0.0
+	for _, sizeCount := range ranked {
+		if covered >= total*percentage/100 {
+			break
 		}
-		if size, err := SizeFromKey(key); err == nil {
-			sizes = append(sizes, size)
-		} else {
-			return nil, err
-		}
-		i += 1
+		sizes = append(sizes, sizeCount.Size)
+		covered += sizeCount.Count
 	}
 	return sizes, nil
 }
 
-// TODO: GetTopSizesByPercentage?
-
 // Close stops the SizeCounter from doing any more persistence.
 func (counter *SizeCounter) Close() {
 	close(counter.done)
@@ -0,0 +1,158 @@
+package slimgfast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SIZE_STATS_PATH is the path that a node serves its size counts on, for its
+// peers to pull.
+const SIZE_STATS_PATH = "/_slimgfast/sizes"
+
+// DEFAULT_PEER_PULL_INTERVAL is how often a SizeCounter pulls its peers' size
+// counts by default.
+const DEFAULT_PEER_PULL_INTERVAL = 1 * time.Minute
+
+// SizeStats is the JSON served on SIZE_STATS_PATH: a node's own count for
+// each size key, time decayed if the node has a half-life set.
+type SizeStats struct {
+	Counts map[string]float64
+}
+
+// ServeHTTP serves the counter's own size counts as JSON, so that its peers
+// can merge them into their rankings.  Counts pulled from peers are left out,
+// so that nothing is counted twice.
+func (counter *SizeCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counter.mut.RLock()
+	stats := SizeStats{Counts: counter.scores(time.Now())}
+	counter.mut.RUnlock()
+	data, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// SetPeers sets the base URLs of the other nodes in the cluster, which the
+// counter pulls size counts from to rank sizes cluster-wide.  It takes the
+// same list as groupcache's HTTPPool.Set, and self is this node's own URL,
+// which is left out.  Counts from nodes no longer in the list are dropped.
+func (counter *SizeCounter) SetPeers(self string, peers ...string) {
+	counter.mut.Lock()
+	defer counter.mut.Unlock()
+	counter.peers = make([]string, 0, len(peers))
+	peerCounts := make(map[string]map[string]float64, len(peers))
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		counter.peers = append(counter.peers, peer)
+		if counts, ok := counter.peerCounts[peer]; ok {
+			peerCounts[peer] = counts
+		}
+	}
+	counter.peerCounts = peerCounts
+}
+
+// PullPeers pulls the latest size counts from each of the counter's peers.  A
+// peer that can't be reached keeps its last known counts, and the first such
+// error is returned once all the peers have been tried.
+func (counter *SizeCounter) PullPeers(ctx context.Context) error {
+	counter.mut.RLock()
+	peers := counter.peers
+	counter.mut.RUnlock()
+	var firstErr error
+	for _, peer := range peers {
+		counts, err := fetchPeerSizes(ctx, peer)
+		if err != nil {
+			log.Println("Could not pull size counts from", peer, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		counter.mut.Lock()
+		// The peers may have changed while we were fetching
+		for _, current := range counter.peers {
+			if current == peer {
+				counter.peerCounts[peer] = counts
+				break
+			}
+		}
+		counter.mut.Unlock()
+	}
+	return firstErr
+}
+
+// StartPullingPeers starts the counter pulling its peers' size counts
+// periodically, until it's closed.
+func (counter *SizeCounter) StartPullingPeers(every time.Duration) {
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), every)
+				counter.PullPeers(ctx)
+				cancel()
+			case <-counter.done:
+				return
+			}
+		}
+	}()
+}
+
+// clusterScores returns the counts that sizes are ranked by: the counter's own
+// counts, plus the latest counts pulled from each of its peers.  The counter
+// must be read locked.
+func (counter *SizeCounter) clusterScores(now time.Time) map[string]float64 {
+	scores := counter.scores(now)
+	for _, counts := range counter.peerCounts {
+		for key, count := range counts {
+			scores[key] += count
+		}
+	}
+	return scores
+}
+
+// fetchPeerSizes gets a peer's size counts from its SIZE_STATS_PATH.  Anything
+// that doesn't look like a size count is thrown away, so that one bad peer
+// can't break the rankings.
+func fetchPeerSizes(ctx context.Context, peer string) (map[string]float64, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(peer, "/")+SIZE_STATS_PATH, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Got status %d from %s", resp.StatusCode, peer)
+	}
+	var stats SizeStats
+	if err = json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]float64, len(stats.Counts))
+	for key, count := range stats.Counts {
+		if _, err := SizeFromKey(key); err != nil {
+			continue
+		}
+		if count <= 0 || math.IsInf(count, 0) || math.IsNaN(count) {
+			continue
+		}
+		counts[key] = count
+	}
+	return counts, nil
+}
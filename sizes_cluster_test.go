@@ -0,0 +1,68 @@
+package slimgfast
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSizeCounterServeHTTP(t *testing.T) {
+	counter := newTestSizeCounter(map[string]uint{"100x100": 3, "200x*": 1})
+	counter.peerCounts = map[string]map[string]float64{"http://peer": {"100x100": 50}}
+	w := httptest.NewRecorder()
+	counter.ServeHTTP(w, httptest.NewRequest("GET", SIZE_STATS_PATH, nil))
+	var stats SizeStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Only the node's own counts are served
+	expected := map[string]float64{"100x100": 3, "200x*": 1}
+	if !reflect.DeepEqual(stats.Counts, expected) {
+		t.Error("Expected", expected, "got:", stats.Counts)
+	}
+}
+
+func TestSizeCounterPullPeers(t *testing.T) {
+	peer := newTestSizeCounter(map[string]uint{"300x300": 10, "100x100": 2})
+	peerServer := httptest.NewServer(peer)
+	defer peerServer.Close()
+	badPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Counts":{"bogus":1000,"400x400":-5,"500x500":1}}`))
+	}))
+	defer badPeer.Close()
+	downPeer := httptest.NewServer(http.NotFoundHandler())
+	defer downPeer.Close()
+
+	counter := newTestSizeCounter(map[string]uint{"100x100": 5, "200x200": 4})
+	counter.SetPeers("http://self", "http://self", peerServer.URL, badPeer.URL, downPeer.URL)
+	if err := counter.PullPeers(context.Background()); err == nil {
+		t.Error("Expected an error from the peer that's down")
+	}
+
+	ranked, err := counter.GetRankedSizes()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []SizeCount{
+		{Size{300, 300}, 10},
+		{Size{100, 100}, 7},
+		{Size{200, 200}, 4},
+		{Size{500, 500}, 1},
+	}
+	if !reflect.DeepEqual(ranked, expected) {
+		t.Error("Expected cluster-wide rankings", expected, "got:", ranked)
+	}
+
+	// Dropping a peer drops its counts
+	counter.SetPeers("http://self", "http://self", badPeer.URL)
+	sizes, err := counter.GetTopSizesByCount(1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sizes) != 1 || sizes[0] != (Size{100, 100}) {
+		t.Error("Expected the dropped peer's counts to be gone, got:", sizes)
+	}
+}
@@ -1,8 +1,15 @@
 package slimgfast
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func GetTmpSizesJson() string {
@@ -38,8 +45,28 @@ func TestSizeFromKey(t *testing.T) {
 	}
 }
 
+func TestSizeFromWildcardKey(t *testing.T) {
+	size, err := SizeFromKey("300x*")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if size.Width != 300 || size.Height != 0 {
+		t.Error("Expected 300x0, got:", size)
+	}
+	if size.Key() != "300x*" {
+		t.Error("Expected the key to round trip, got:", size.Key())
+	}
+	size, err = SizeFromKey("*x120")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if size.Width != 0 || size.Height != 120 {
+		t.Error("Expected 0x120, got:", size)
+	}
+}
+
 func TestSizeFromBadKey(t *testing.T) {
-	badKeys := []string{"Zx15", "-12x-12", "-12x12", "asdf", "x", "nxnull", ""}
+	badKeys := []string{"Zx15", "-12x-12", "-12x12", "asdf", "x", "nxnull", "", "*x*", "1x2x3"}
 	for _, key := range badKeys {
 		size, err := SizeFromKey(key)
 		if err == nil {
@@ -71,3 +98,279 @@ func TestNewSizeCounterWithData(t *testing.T) {
 
 }
 */
+
+// newTestSizeCounter returns a SizeCounter seeded with the given counts, which
+// isn't backed by a file.
+func newTestSizeCounter(counts map[string]uint) *SizeCounter {
+	return &SizeCounter{
+		counts: counts,
+		done:   make(chan struct{}),
+		mut:    &sync.RWMutex{},
+	}
+}
+
+var testSizeCounts = map[string]uint{
+	"100x100": 5,
+	"200x*":   50,
+	"*x300":   20,
+	"400x400": 20,
+	"10x10":   1,
+}
+
+func sizeKeys(sizes []Size) []string {
+	keys := []string{}
+	for _, size := range sizes {
+		keys = append(keys, size.Key())
+	}
+	return keys
+}
+
+func TestGetTopSizesByCount(t *testing.T) {
+	counter := newTestSizeCounter(testSizeCounts)
+	tests := []struct {
+		count    uint
+		expected []string
+	}{
+		{0, []string{}},
+		// Ties are broken by key
+		{3, []string{"200x*", "*x300", "400x400"}},
+		{10, []string{"200x*", "*x300", "400x400", "100x100", "10x10"}},
+	}
+	for _, test := range tests {
+		sizes, err := counter.GetTopSizesByCount(test.count)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if keys := sizeKeys(sizes); !reflect.DeepEqual(keys, test.expected) {
+			t.Error("Expected top", test.count, "to be", test.expected, "got:", keys)
+		}
+	}
+}
+
+func TestGetTopSizesByPercentage(t *testing.T) {
+	counter := newTestSizeCounter(testSizeCounts)
+	tests := []struct {
+		percentage float64
+		expected   []string
+	}{
+		{10, []string{"200x*"}},
+		{50, []string{"200x*"}},
+		{60, []string{"200x*", "*x300"}},
+		{80, []string{"200x*", "*x300", "400x400"}},
+		{100, []string{"200x*", "*x300", "400x400", "100x100", "10x10"}},
+	}
+	for _, test := range tests {
+		sizes, err := counter.GetTopSizesByPercentage(test.percentage)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if keys := sizeKeys(sizes); !reflect.DeepEqual(keys, test.expected) {
+			t.Error("Expected", test.percentage, "percent to be", test.expected, "got:", keys)
+		}
+	}
+	for _, percentage := range []float64{0, -5, 101} {
+		if _, err := counter.GetTopSizesByPercentage(percentage); err == nil {
+			t.Error("Expected an error for percentage:", percentage)
+		}
+	}
+}
+
+func TestSizeCounterTimeDecay(t *testing.T) {
+	counter := newTestSizeCounter(map[string]uint{"100x100": 100})
+	counter.SetHalfLife(time.Hour)
+	start := counter.decayEpoch
+	if scores := counter.scores(start); scores["100x100"] != 100 {
+		t.Error("Expected decay to start from the raw counts, got:", scores)
+	}
+
+	// Ten half-lives later, one new request outweighs the 100 old ones.
+	later := start.Add(10 * time.Hour)
+	counter.addWeight("200x200", later)
+	scores := counter.scores(later)
+	if scores["100x100"] != 100.0/1024 || scores["200x200"] != 1 {
+		t.Error("Expected the old counts to have decayed, got:", scores)
+	}
+
+	// Far enough in the future, the weights are rebased to avoid overflow.
+	muchLater := start.Add(100 * time.Hour)
+	counter.addWeight("200x200", muchLater)
+	if !counter.decayEpoch.Equal(muchLater) {
+		t.Error("Expected the weights to be rebased")
+	}
+	scores = counter.scores(muchLater)
+	if scores["200x200"] < 1 || scores["200x200"] > 1.000001 {
+		t.Error("Expected the decayed counts to survive rebasing, got:", scores)
+	}
+
+	counter.SetHalfLife(0)
+	if scores := counter.scores(muchLater); scores["100x100"] != 100 {
+		t.Error("Expected raw counts with decay off, got:", scores)
+	}
+}
+
+func TestSizeCounterHalfLifeChange(t *testing.T) {
+	counter := newTestSizeCounter(map[string]uint{"100x100": 100})
+	counter.SetHalfLife(time.Hour)
+	// Two half-lives have passed, so the 100 requests count as 25
+	counter.decayEpoch = counter.decayEpoch.Add(-2 * time.Hour)
+	counter.SetHalfLife(10 * time.Hour)
+	if score := counter.scores(counter.decayEpoch)["100x100"]; math.Abs(score-25) > 0.01 {
+		t.Error("Expected the weights decayed with the old half-life, got:", score)
+	}
+
+	// The decay factor can't overflow, however long it's been
+	for _, now := range []time.Time{
+		counter.decayEpoch.Add(-100000 * time.Hour),
+		counter.decayEpoch.Add(100000 * time.Hour),
+	} {
+		score := counter.scores(now)["100x100"]
+		if math.IsInf(score, 0) || math.IsNaN(score) || score > 25.01 {
+			t.Error("Expected a finite decayed weight at", now, "got:", score)
+		}
+	}
+}
+
+func TestSizeCounterRebasesOnLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slimgfast_sizes")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sizes.json")
+
+	// Weights saved three one-hour half-lives ago
+	data, err := json.Marshal(SizeFile{
+		Counts:     map[string]uint{"10x10": 8, "20x20": 8},
+		Weights:    map[string]float64{"10x10": 8, "20x20": 8},
+		DecayEpoch: time.Now().Add(-3 * time.Hour),
+		HalfLife:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	counter, err := NewSizeCounter(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	counter.SetHalfLife(24 * time.Hour)
+	if score := counter.scores(counter.decayEpoch)["10x10"]; math.Abs(score-1) > 0.01 {
+		t.Error("Expected the saved weights decayed with their own half-life, got:", score)
+	}
+}
+
+func TestSizeCounterKeepsBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slimgfast_sizes")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sizes.json")
+
+	counter, err := NewSizeCounter(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	counter.CountSize(&Size{Width: 10, Height: 10})
+	if err = saveFile(counter); err != nil {
+		t.Fatal(err.Error())
+	}
+	counter.CountSize(&Size{Width: 10, Height: 10})
+	if err = saveFile(counter); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Simulate a crash that left a truncated sizes file behind
+	if err = ioutil.WriteFile(filename, []byte(`{"Counts":{"10x`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	counter, err = NewSizeCounter(filename)
+	if err != nil {
+		t.Fatal("Expected a corrupt sizes file not to be fatal, got:", err)
+	}
+	if count := counter.counts["10x10"]; count != 1 {
+		t.Error("Expected the count from the backup, got:", count)
+	}
+
+	// The corrupt file mustn't replace the good backup
+	counter.CountSize(&Size{Width: 20, Height: 20})
+	if err = saveFile(counter); err != nil {
+		t.Fatal(err.Error())
+	}
+	backup, err := getSizeFileFromFilename(backupFilename(filename))
+	if err != nil {
+		t.Fatal("Expected the backup to still be good, got:", err)
+	}
+	if count := backup.Counts["10x10"]; count != 1 {
+		t.Error("Expected the backup to be untouched, got:", backup.Counts)
+	}
+	saved, err := getSizeFileFromFilename(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if saved.Counts["10x10"] != 1 || saved.Counts["20x20"] != 1 {
+		t.Error("Expected the new counts to be saved, got:", saved.Counts)
+	}
+}
+
+func TestSizeCounterBadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slimgfast_sizes")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sizes.json")
+
+	for _, content := range []string{`{"Counts":null}`, `{}`, `null`, `garbage`} {
+		if err = ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		counter, err := NewSizeCounter(filename)
+		if err != nil {
+			t.Error("Expected a bad sizes file not to be fatal, got:", err)
+			continue
+		}
+		// This used to panic on a nil map
+		counter.CountSize(&Size{Width: 10, Height: 10})
+		if count := counter.counts["10x10"]; count != 1 {
+			t.Error("Expected a fresh count for", content, "got:", count)
+		}
+	}
+}
+
+func TestSizeCounterMissingFileUsesBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slimgfast_sizes")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sizes.json")
+
+	counter, err := NewSizeCounter(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		counter.CountSize(&Size{Width: 10, Height: 10})
+		if err = saveFile(counter); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err = os.Stat(filename); err != nil {
+			t.Fatal("Expected the sizes file to stay in place, got:", err)
+		}
+	}
+
+	// Simulate a crash that left only the backup behind
+	if err = os.Remove(filename); err != nil {
+		t.Fatal(err.Error())
+	}
+	counter, err = NewSizeCounter(filename)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count := counter.counts["10x10"]; count != 1 {
+		t.Error("Expected the count from the backup, got:", count)
+	}
+}
@@ -1,55 +1,246 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/ericflo/slimgfast"
 	"github.com/ericflo/slimgfast/fetchers"
 	"github.com/golang/groupcache"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
-var COUNTER_FILENAME = *flag.String(
+var COUNTER_FILENAME = flag.String(
 	"counter_filename",
 	"/tmp/slimfast_sizes.json",
 	"The file where we'll save statistical information about which sizes were requested",
 )
-var GROUPCACHE_HOSTS = *flag.String(
+var GROUPCACHE_HOSTS = flag.String(
 	"groupcache_hosts",
 	"http://localhost:4401",
 	"The URL prefix that you would like to assign to groupcache",
 )
-var PORT = *flag.String("port", "4400", "The port to serve images on")
-var NUM_WORKERS = *flag.Int(
+var PEERS = flag.String(
+	"peers",
+	"",
+	"A comma separated list of the groupcache URL prefixes of every node in the cluster, including this one's -groupcache_hosts",
+)
+var PORT = flag.String("port", "4400", "The port to serve images on")
+var NUM_WORKERS = flag.Int(
 	"num_workers",
 	4,
 	"The number of worker goroutines to spawn",
 )
-var OUTPUT_CACHE_MB = int64(*flag.Int(
+var OUTPUT_CACHE_MB = flag.Int64(
 	"output_cache_mb",
 	512,
 	"The amount of cache to reserve for resized images",
-))
-var MAX_WIDTH = *flag.Int(
+)
+var MAX_WIDTH = flag.Int(
 	"max_width",
 	2048,
 	"The max width of the resized image",
 )
-var MAX_HEIGHT = *flag.Int(
+var MAX_HEIGHT = flag.Int(
 	"max_height",
 	2048,
 	"The max height of the resized image",
 )
+var DEFAULT_QUALITY = flag.Int(
+	"default_quality",
+	slimgfast.DEFAULT_QUALITY,
+	"The output quality used when a request doesn't specify one with q=",
+)
+var MIN_QUALITY = flag.Int(
+	"min_quality",
+	slimgfast.DEFAULT_MIN_QUALITY,
+	"The lowest output quality that can be requested with q=",
+)
+var MAX_QUALITY = flag.Int(
+	"max_quality",
+	slimgfast.DEFAULT_MAX_QUALITY,
+	"The highest output quality that can be requested with q=",
+)
+var CACHE_MAX_AGE = flag.Duration(
+	"cache_max_age",
+	slimgfast.DEFAULT_CACHE_MAX_AGE,
+	"How long clients and CDNs may cache resized images (Cache-Control max-age)",
+)
+var VARY_HEADERS = flag.String(
+	"vary_headers",
+	"",
+	"A comma separated list of headers to send in the Vary header of image responses",
+)
+var ERROR_IMAGES = flag.Bool(
+	"error_images",
+	false,
+	"Serve placeholder images in the requested size instead of plain text errors",
+)
+var FALLBACK_IMAGE = flag.String(
+	"fallback_image",
+	"",
+	"The path of an image to serve (resized as requested) when an image is not found",
+)
+var DEBUG = flag.Bool(
+	"debug",
+	false,
+	"Send the full text of errors to clients",
+)
+var REQUEST_TIMEOUT = flag.Duration(
+	"request_timeout",
+	slimgfast.DEFAULT_REQUEST_TIMEOUT,
+	"How long a request may take to fetch and resize its image before giving up",
+)
+var MAX_FETCHES = flag.Int(
+	"max_fetches",
+	slimgfast.DEFAULT_MAX_CONCURRENT_FETCHES,
+	"The number of source images that can be fetched at once",
+)
+var MAX_QUEUE = flag.Int(
+	"max_queue",
+	0,
+	"The number of images that can be waiting for a worker before requests are rejected with a 503 (0 for no limit)",
+)
+var QUEUE_TIMEOUT = flag.Duration(
+	"queue_timeout",
+	0,
+	"How long an image may wait for a worker before the request is rejected with a 503 (0 for no limit)",
+)
+var BACKGROUND_SHARE = flag.Int(
+	"background_share",
+	slimgfast.DEFAULT_BACKGROUND_SHARE,
+	"Background jobs get at least one in every this many jobs when user requests are also waiting (0 to only run them when idle)",
+)
+var PREWARM_LIST = flag.String(
+	"prewarm_list",
+	"",
+	"A file listing source image paths, one per line, to generate the most requested sizes of at startup",
+)
+var PREWARM_DIR = flag.Bool(
+	"prewarm_dir",
+	false,
+	"Generate the most requested sizes of every image under the filesystem prefix at startup",
+)
+var PREWARM_SIZES = flag.Uint(
+	"prewarm_sizes",
+	slimgfast.DEFAULT_PREWARM_TOP_SIZES,
+	"How many of the most requested sizes to prewarm each image at",
+)
+var SIZE_HALF_LIFE = flag.Duration(
+	"size_half_life",
+	0,
+	"How long it takes for a request to count half as much when ranking the most requested sizes (0 for no decay)",
+)
+var SIZE_POLICY = flag.String(
+	"size_policy",
+	"",
+	"What to do with requests for sizes that aren't allowed: reject, snap or redirect (empty to allow every size)",
+)
+var ALLOWED_SIZES = flag.String(
+	"allowed_sizes",
+	"",
+	"A comma separated list of the sizes allowed by -size_policy, like 640x480,300x*",
+)
+var ALLOW_TOP_SIZES = flag.Uint(
+	"allow_top_sizes",
+	0,
+	"Also allow this many of the most requested sizes under -size_policy",
+)
+var ALLOW_TOP_SIZES_MIN_COUNT = flag.Float64(
+	"allow_top_sizes_min_count",
+	slimgfast.DEFAULT_ALLOW_TOP_SIZES_MIN_COUNT,
+	"How many times a size has to be requested before -allow_top_sizes allows it",
+)
+var SIGNING_KEYS_FILE = flag.String(
+	"signing_keys_file",
+	"",
+	"A file of keys, one per line, to only serve URLs signed with (the first is used for new signatures)",
+)
+var MAX_SOURCE_BYTES = flag.Int64(
+	"max_source_bytes",
+	slimgfast.DEFAULT_MAX_SOURCE_BYTES,
+	"The largest source image, in bytes, that will be fetched (-1 for no limit)",
+)
+var MAX_SOURCE_PIXELS = flag.Int64(
+	"max_source_pixels",
+	slimgfast.DEFAULT_MAX_SOURCE_PIXELS,
+	"The most pixels a source image can have before it's refused (0 for no limit)",
+)
+var PROXY_CONNECT_TIMEOUT = flag.Duration(
+	"proxy_connect_timeout",
+	fetchers.DEFAULT_CONNECT_TIMEOUT,
+	"How long connecting to the proxied server may take",
+)
+var PROXY_READ_TIMEOUT = flag.Duration(
+	"proxy_read_timeout",
+	fetchers.DEFAULT_READ_TIMEOUT,
+	"How long the proxied server has to start responding, and then to send the whole image",
+)
+var PROXY_MAX_IDLE_CONNS = flag.Int(
+	"proxy_max_idle_conns",
+	fetchers.DEFAULT_MAX_IDLE_CONNS,
+	"How many idle connections to the proxied server to keep open",
+)
+var PROXY_RETRIES = flag.Int(
+	"proxy_retries",
+	2,
+	"How many times to retry a request to the proxied server that failed with a 5xx or network error",
+)
+var PROXY_USER_AGENT = flag.String(
+	"proxy_user_agent",
+	fetchers.DEFAULT_USER_AGENT,
+	"The User-Agent to send to the proxied server",
+)
+var PROXY_HEADERS_FILE = flag.String(
+	"proxy_headers_file",
+	"",
+	"A file of headers, one \"Name: value\" per line, to send to the proxied server (e.g. Authorization)",
+)
+var FORWARD_HEADERS = flag.String(
+	"forward_headers",
+	"",
+	"A comma separated list of client request headers to pass on to the proxied server",
+)
+var PROXY_MAX_REDIRECTS = flag.Int(
+	"proxy_max_redirects",
+	fetchers.DEFAULT_MAX_REDIRECTS,
+	"How many redirects from the proxied server to follow (-1 for none)",
+)
+var PROXY_REDIRECT_HOSTS = flag.String(
+	"proxy_redirect_hosts",
+	"",
+	"A comma separated list of other hosts (e.g. cdn.example.com or *.example.com) the proxied server may redirect to",
+)
+var SOURCE_CHECK_INTERVAL = flag.Duration(
+	"source_check_interval",
+	slimgfast.DEFAULT_SOURCE_CHECK_INTERVAL,
+	"How often to check whether a source file has changed, so it's resized again (0 to never check)",
+)
+var SYMLINKS = flag.String(
+	"symlinks",
+	fetchers.SYMLINKS_WITHIN_ROOT,
+	"How the filesystem fetcher treats symlinks: within_root, deny or follow",
+)
+var ALLOWED_EXTENSIONS = flag.String(
+	"allowed_extensions",
+	".jpg,.jpeg,.png,.gif",
+	"A comma separated list of the file extensions the filesystem fetcher will serve (empty for any)",
+)
 
 func parseFlags() slimgfast.Fetcher {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "Usage of slimgfastd: slimgfastd [OPTIONS] COMMAND PREFIX\n")
-		fmt.Fprintf(os.Stderr, "Available commands: proxy, filesystem\n")
-		fmt.Fprintf(os.Stderr, "Note: PREFIX is the URL prefix for proxying, or the file path prefix for filesystem\n\n")
+		fmt.Fprintf(os.Stderr, "Available commands: proxy, filesystem, origins\n")
+		fmt.Fprintf(os.Stderr, "Note: PREFIX is the URL prefix for proxying, the file path prefix for filesystem, or a comma separated list of allowed hosts for origins\n\n")
 		fmt.Fprintf(os.Stderr, "Example: slimgfastd -num_workers 8 proxy http://i.imgur.com\n")
+		fmt.Fprintf(os.Stderr, "Example: slimgfastd origins cdn.partner.com,*.images.example.com\n")
 		fmt.Fprintf(os.Stderr, "Example: slimgfastd -output_cache_mb 128 filesystem /srv/project/static/images\n\n")
 		fmt.Fprintf(os.Stderr, "Defaults:\n")
 		flag.PrintDefaults()
@@ -66,15 +257,44 @@ func parseFlags() slimgfast.Fetcher {
 	}
 
 	var fetcher slimgfast.Fetcher
-	if command == "proxy" || command == "filesystem" {
+	if command == "proxy" || command == "filesystem" || command == "origins" {
 		prefix := flag.Arg(1)
 		if prefix == "" {
 			flag.Usage()
 		}
 		if command == "proxy" {
-			fetcher = &fetchers.ProxyFetcher{ProxyUrlPrefix: prefix}
+			proxyFetcher := &fetchers.ProxyFetcher{ProxyUrlPrefix: prefix}
+			configureProxy(proxyFetcher)
+			fetcher = proxyFetcher
+		} else if command == "origins" {
+			originFetcher := &fetchers.MultiOriginFetcher{
+				AllowedHosts: splitList(prefix),
+			}
+			// Headers would be sent to every allowed host alike
+			if *PROXY_HEADERS_FILE != "" || *FORWARD_HEADERS != "" {
+				log.Fatal("The proxy_headers_file and forward_headers flags can't be used with origins")
+			}
+			configureProxy(&originFetcher.ProxyFetcher)
+			fetcher = originFetcher
 		} else {
-			fetcher = &fetchers.FilesystemFetcher{PathPrefix: prefix}
+			fsFetcher := &fetchers.FilesystemFetcher{
+				PathPrefix:    prefix,
+				MaxBytes:      *MAX_SOURCE_BYTES,
+				SymlinkPolicy: *SYMLINKS,
+			}
+			switch *SYMLINKS {
+			case fetchers.SYMLINKS_WITHIN_ROOT, fetchers.SYMLINKS_DENY, fetchers.SYMLINKS_FOLLOW:
+			default:
+				log.Fatal("Unknown symlink policy: " + *SYMLINKS)
+			}
+			if *ALLOWED_EXTENSIONS != "" {
+				for _, ext := range strings.Split(*ALLOWED_EXTENSIONS, ",") {
+					if ext = strings.TrimSpace(ext); ext != "" {
+						fsFetcher.AllowedExtensions = append(fsFetcher.AllowedExtensions, ext)
+					}
+				}
+			}
+			fetcher = fsFetcher
 		}
 	} else {
 		if command == "s3" {
@@ -85,6 +305,128 @@ func parseFlags() slimgfast.Fetcher {
 	return fetcher
 }
 
+// configureProxy applies the proxy flags to a ProxyFetcher.
+func configureProxy(proxyFetcher *fetchers.ProxyFetcher) {
+	proxyFetcher.MaxBytes = *MAX_SOURCE_BYTES
+	proxyFetcher.ConnectTimeout = *PROXY_CONNECT_TIMEOUT
+	proxyFetcher.ReadTimeout = *PROXY_READ_TIMEOUT
+	proxyFetcher.MaxIdleConns = *PROXY_MAX_IDLE_CONNS
+	proxyFetcher.MaxRetries = *PROXY_RETRIES
+	proxyFetcher.UserAgent = *PROXY_USER_AGENT
+	proxyFetcher.MaxRedirects = *PROXY_MAX_REDIRECTS
+	proxyFetcher.RedirectHosts = splitList(*PROXY_REDIRECT_HOSTS)
+	if *PROXY_HEADERS_FILE != "" {
+		headers, err := readHeaders(*PROXY_HEADERS_FILE)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxyFetcher.Headers = headers
+	}
+	proxyFetcher.ForwardHeaders = splitList(*FORWARD_HEADERS)
+}
+
+// splitList splits a comma separated flag value, trimming the spaces around
+// each entry and dropping empty ones.
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// prewarm generates the most requested sizes of the images named by the
+// prewarm flags.
+func prewarm(app *slimgfast.App, fetcher slimgfast.Fetcher) {
+	paths := []string{}
+	if *PREWARM_LIST != "" {
+		file, err := os.Open(*PREWARM_LIST)
+		if err != nil {
+			log.Println("Could not open prewarm list:", err)
+			return
+		}
+		listed, err := slimgfast.ReadPathList(file)
+		file.Close()
+		if err != nil {
+			log.Println("Could not read prewarm list:", err)
+			return
+		}
+		paths = append(paths, listed...)
+	}
+	if *PREWARM_DIR {
+		fsFetcher, ok := fetcher.(*fetchers.FilesystemFetcher)
+		if !ok {
+			log.Println("The prewarm_dir flag only works with the filesystem command")
+			return
+		}
+		walked, err := fsFetcher.Paths()
+		if err != nil {
+			log.Println("Could not walk prewarm directory:", err)
+			return
+		}
+		paths = append(paths, walked...)
+	}
+	if len(paths) == 0 {
+		return
+	}
+	generated, err := app.Prewarm(context.Background(), paths)
+	if err != nil {
+		log.Println("Prewarming stopped early:", err)
+	}
+	log.Printf("Prewarmed %d images from %d source images", generated, len(paths))
+}
+
+// readSigningKeys reads the non-blank lines of a file as signing keys.
+func readSigningKeys(filename string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys := [][]byte{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No signing keys in %s", filename)
+	}
+	return keys, nil
+}
+
+// readHeaders reads the headers to send to the proxied server out of a file,
+// one "Name: value" per line.  Blank lines are skipped.
+func readHeaders(filename string) (http.Header, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			// The line isn't quoted, since it could hold a secret
+			return nil, fmt.Errorf("Bad header on line %d of %s", i+1, filename)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+// listenAddr gets the address to listen on out of a URL prefix like
+// "http://localhost:4401".
+func listenAddr(urlPrefix string) string {
+	if parsed, err := url.Parse(urlPrefix); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return urlPrefix
+}
+
 func main() {
 	fetcher := parseFlags()
 
@@ -96,26 +438,94 @@ func main() {
 	app, err := slimgfast.NewApp(
 		fetcher,
 		transformers,
-		COUNTER_FILENAME,
-		NUM_WORKERS,
-		OUTPUT_CACHE_MB,
-		MAX_WIDTH,
-		MAX_HEIGHT,
+		*COUNTER_FILENAME,
+		*NUM_WORKERS,
+		*OUTPUT_CACHE_MB,
+		*MAX_WIDTH,
+		*MAX_HEIGHT,
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
+	app.DefaultQuality = *DEFAULT_QUALITY
+	app.MinQuality = *MIN_QUALITY
+	app.MaxQuality = *MAX_QUALITY
+	app.CacheMaxAge = *CACHE_MAX_AGE
+	app.VaryHeaders = splitList(*VARY_HEADERS)
+	app.ErrorImages = *ERROR_IMAGES
+	app.FallbackImagePath = *FALLBACK_IMAGE
+	app.Debug = *DEBUG
+	app.RequestTimeout = *REQUEST_TIMEOUT
+	app.MaxConcurrentFetches = *MAX_FETCHES
+	app.MaxQueue = *MAX_QUEUE
+	app.QueueTimeout = *QUEUE_TIMEOUT
+	app.BackgroundShare = *BACKGROUND_SHARE
+	app.PrewarmTopSizes = *PREWARM_SIZES
+	app.SizeHalfLife = *SIZE_HALF_LIFE
+	app.MaxSourcePixels = *MAX_SOURCE_PIXELS
+	app.SourceCheckInterval = *SOURCE_CHECK_INTERVAL
+	switch *SIZE_POLICY {
+	case "", slimgfast.SIZE_POLICY_REJECT, slimgfast.SIZE_POLICY_SNAP, slimgfast.SIZE_POLICY_REDIRECT:
+		app.SizePolicy = *SIZE_POLICY
+	default:
+		log.Fatal("Unknown size policy: " + *SIZE_POLICY)
+	}
+	if *ALLOWED_SIZES != "" {
+		for _, key := range strings.Split(*ALLOWED_SIZES, ",") {
+			size, err := slimgfast.SizeFromKey(strings.TrimSpace(key))
+			if err != nil {
+				log.Fatal(err)
+			}
+			app.AllowedSizes = append(app.AllowedSizes, size)
+		}
+	}
+	app.AllowTopSizes = *ALLOW_TOP_SIZES
+	app.AllowTopSizesMinCount = *ALLOW_TOP_SIZES_MIN_COUNT
+	if *SIGNING_KEYS_FILE != "" {
+		if app.SigningKeys, err = readSigningKeys(*SIGNING_KEYS_FILE); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// Set up our groupcache pool
-	peers := groupcache.NewHTTPPool(GROUPCACHE_HOSTS)
-	go http.ListenAndServe(GROUPCACHE_HOSTS, http.HandlerFunc(peers.ServeHTTP))
+	// Publish the worker stats, so the pool can be tuned.  Importing expvar
+	// serves /debug/vars on the default ServeMux, which only the groupcache
+	// listener uses, so they aren't on the public port.
+	expvar.Publish("slimgfast_workers", expvar.Func(func() interface{} {
+		return app.WorkerStats()
+	}))
+
+	// Set up our groupcache pool, and share our size counts with our peers
+	peers := groupcache.NewHTTPPool(*GROUPCACHE_HOSTS)
+	if peerList := splitList(*PEERS); len(peerList) > 0 {
+		// Our own URL has to be in the list as given, or we'd pull our own
+		// size counts and count them twice
+		found := false
+		for _, peer := range peerList {
+			found = found || peer == *GROUPCACHE_HOSTS
+		}
+		if !found {
+			log.Fatal("The peers flag must include this node's groupcache_hosts: " + *GROUPCACHE_HOSTS)
+		}
+		peers.Set(peerList...)
+		app.SetPeers(*GROUPCACHE_HOSTS, peerList...)
+	}
+	// The pool registers itself with the default ServeMux
+	http.Handle(slimgfast.SIZE_STATS_PATH, app.SizeCounter())
+	go func() {
+		log.Fatal(http.ListenAndServe(listenAddr(*GROUPCACHE_HOSTS), nil))
+	}()
 
 	// Start the app
 	app.Start()
 	defer app.Close()
 
+	// Prewarm popular sizes in the background
+	go prewarm(app, fetcher)
+
 	// Start the HTTP server
-	if err = http.ListenAndServe(":"+PORT, app); err != nil {
+	mux := http.NewServeMux()
+	mux.Handle("/", app)
+	if err = http.ListenAndServe(":"+*PORT, mux); err != nil {
 		log.Fatal(err)
 	}
 }
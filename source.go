@@ -1,17 +1,47 @@
 package slimgfast
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/lru"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
 const DEFAULT_IMAGE_SOURCE_NAME = "slimgfast_image_source"
 const DEFAULT_CACHE_SIZE_MB = int64(128)
 
+// DEFAULT_MAX_CONCURRENT_FETCHES is how many fetches an ImageSource will run at
+// once by default.  Fetching is I/O bound, so this can be much higher than the
+// number of workers.
+const DEFAULT_MAX_CONCURRENT_FETCHES = 64
+
+// DEFAULT_STAT_CACHE_ENTRIES is how many source images an ImageSource
+// remembers the version of, for fetchers that implement StatFetcher.
+const DEFAULT_STAT_CACHE_ENTRIES = 10000
+
 // ImageSource is an abstraction over a fetcher which caches intelligently, and
 // serves as the primary internal interface to fetchers.
 type ImageSource struct {
-	cache *groupcache.Group
+	cache       *groupcache.Group
+	fetchSlots  chan struct{}
+	statFetcher StatFetcher
+	statMut     sync.Mutex
+	statCache   *lru.Cache
+	// statInterval is how long a source image's version is trusted for
+	// before it's checked again.
+	statInterval time.Duration
+}
+
+// statEntry is a source image's SourceInfo, and when it was looked up.
+type statEntry struct {
+	info    *SourceInfo
+	checked time.Time
 }
 
 // NewImageSource initializes and returns an *ImageSource with sane default
@@ -27,22 +57,203 @@ func NewImageSource(fetcher Fetcher) *ImageSource {
 // NewImageSourceCustomCache initializes and returns an *ImageSource with
 // a custom groupcache name and a custom cache size.
 func NewImageSourceCustomCache(fetcher Fetcher, cacheName string, cacheMegabytes int64) *ImageSource {
-	cache := groupcache.NewGroup(cacheName, cacheMegabytes<<20, groupcache.GetterFunc(
-		func(ctx groupcache.Context, urlPath string, dest groupcache.Sink) error {
-			return fetcher.Fetch(urlPath, dest)
+	contextFetcher := NewContextFetcher(fetcher)
+	src := &ImageSource{statCache: lru.New(DEFAULT_STAT_CACHE_ENTRIES)}
+	src.statFetcher, _ = fetcher.(StatFetcher)
+	src.SetMaxConcurrentFetches(DEFAULT_MAX_CONCURRENT_FETCHES)
+	src.cache = groupcache.NewGroup(cacheName, cacheMegabytes<<20, groupcache.GetterFunc(
+		func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+			urlPath, _ := splitSourceKey(key)
+			fetchCtx := contextFromGroupcache(ctx)
+			release, err := src.acquireFetchSlot(fetchCtx)
+			if err != nil {
+				return err
+			}
+			defer release()
+			var data []byte
+			info, err := contextFetcher.FetchContext(
+				fetchCtx,
+				urlPath,
+				groupcache.AllocatingByteSliceSink(&data),
+			)
+			if err != nil {
+				return err
+			}
+			encoded, err := encodeImageData(info, data)
+			if err != nil {
+				return err
+			}
+			return dest.SetBytes(encoded)
 		}))
-	return &ImageSource{cache: cache}
+	return src
+}
+
+// SetMaxConcurrentFetches limits how many fetches the ImageSource will run at
+// once.  Zero or less means no limit.  It should be called before the
+// ImageSource is put to use.
+func (src *ImageSource) SetMaxConcurrentFetches(max int) {
+	if max > 0 {
+		src.fetchSlots = make(chan struct{}, max)
+	} else {
+		src.fetchSlots = nil
+	}
+}
+
+// SetStatInterval sets how long the ImageSource trusts the version of a source
+// image for, before checking whether it has changed.  It only matters for
+// fetchers that implement StatFetcher.  Zero or less turns version checks
+// off.  It should be called before the ImageSource is put to use.
+func (src *ImageSource) SetStatInterval(interval time.Duration) {
+	src.statInterval = interval
+}
+
+// SourceVersion returns the current version of the source image the request
+// asks for, from SourceInfo.Version.  It's looked up at most once per stat
+// interval for each image.  If versions can't be checked, it's empty.
+func (src *ImageSource) SourceVersion(ctx context.Context, req *ImageRequest) (string, error) {
+	if src.statFetcher == nil || src.statInterval <= 0 {
+		return "", nil
+	}
+	parsedUrl, err := url.ParseRequestURI(req.Url)
+	if err != nil {
+		return "", err
+	}
+	urlPath := parsedUrl.Path
+	src.statMut.Lock()
+	cached, ok := src.statCache.Get(urlPath)
+	src.statMut.Unlock()
+	if ok {
+		entry := cached.(*statEntry)
+		if time.Since(entry.checked) < src.statInterval {
+			return entry.info.Version(), nil
+		}
+	}
+	info, err := src.statFetcher.Stat(ctx, urlPath)
+	if err != nil {
+		return "", err
+	}
+	if info == nil {
+		info = &SourceInfo{}
+	}
+	src.statMut.Lock()
+	src.statCache.Add(urlPath, &statEntry{info: info, checked: time.Now()})
+	src.statMut.Unlock()
+	return info.Version(), nil
+}
+
+// acquireFetchSlot waits for a free fetch slot, or for the context to be
+// done.  The returned function gives the slot back.
+func (src *ImageSource) acquireFetchSlot(ctx context.Context) (func(), error) {
+	slots := src.fetchSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err())
+	}
 }
 
 // GetImageData gets the image data the request asked for, either from cache or
-// from the associated Fetcher.
-func (src *ImageSource) GetImageData(req *ImageRequest) ([]byte, error) {
-	var img []byte
-	imgSink := groupcache.AllocatingByteSliceSink(&img)
+// from the associated Fetcher, along with what the Fetcher knew about it.
+// Each version of a source image is cached separately.
+func (src *ImageSource) GetImageData(ctx context.Context, req *ImageRequest) ([]byte, *SourceInfo, error) {
+	var encoded []byte
+	imgSink := groupcache.AllocatingByteSliceSink(&encoded)
 	parsedUrl, err := url.ParseRequestURI(req.Url)
 	if err != nil {
-		return img, err
+		return nil, nil, err
+	}
+	key := sourceKey(parsedUrl.Path, req.SourceVersion)
+	if err = getShared(ctx, src.cache, key, imgSink); err != nil {
+		return nil, nil, err
+	}
+	return decodeImageData(encoded)
+}
+
+// sourceKey builds the cache key for a version of a source image.  The
+// version is separated from the path by a NUL byte, which is never part of a
+// version, so the last one in the key is always the separator.
+func sourceKey(urlPath string, version string) string {
+	return urlPath + "\x00" + version
+}
+
+// splitSourceKey splits a cache key made by sourceKey back up.
+func splitSourceKey(key string) (string, string) {
+	i := strings.LastIndexByte(key, 0)
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+// MAX_SHARED_LOAD_RETRIES is how many times a cache lookup is tried again
+// after the load it was sharing was called off by another caller.
+const MAX_SHARED_LOAD_RETRIES = 2
+
+// getShared gets a key out of a groupcache group.  Loads are shared between
+// every caller waiting on the same key, but run under the context of the
+// first one, so if that caller goes away the others see its cancellation.
+// When that happens and our own context is still live, the lookup is tried
+// again, which starts a new load.
+func getShared(ctx context.Context, group *groupcache.Group, key string, dest groupcache.Sink) error {
+	var err error
+	for attempt := 0; attempt <= MAX_SHARED_LOAD_RETRIES; attempt++ {
+		err = group.Get(ctx, key, dest)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+	}
+	return err
+}
+
+// contextFromGroupcache gets the context.Context back out of the
+// groupcache.Context handed to a groupcache Getter.  Requests that come in
+// from groupcache peers don't have one, so they get a background context.
+func contextFromGroupcache(ctx groupcache.Context) context.Context {
+	if c, ok := ctx.(context.Context); ok && c != nil {
+		return c
+	}
+	return context.Background()
+}
+
+// encodeImageData bundles up the image data with its SourceInfo, so that the
+// two can be cached (and passed between groupcache peers) together.  The
+// encoding is a big-endian uint32 header length, the header as JSON, and then
+// the image data itself.
+func encodeImageData(info *SourceInfo, data []byte) ([]byte, error) {
+	if info == nil {
+		info = &SourceInfo{}
+	}
+	header, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, 4+len(header)+len(data))
+	binary.BigEndian.PutUint32(encoded, uint32(len(header)))
+	copy(encoded[4:], header)
+	copy(encoded[4+len(header):], data)
+	return encoded, nil
+}
+
+// decodeImageData splits data encoded by encodeImageData back into the image
+// data and its SourceInfo.
+func decodeImageData(encoded []byte) ([]byte, *SourceInfo, error) {
+	if len(encoded) < 4 {
+		return nil, nil, errors.New("Cached image data is truncated")
+	}
+	headerLen := int(binary.BigEndian.Uint32(encoded))
+	if len(encoded) < 4+headerLen {
+		return nil, nil, errors.New("Cached image data is truncated")
+	}
+	info := &SourceInfo{}
+	if err := json.Unmarshal(encoded[4:4+headerLen], info); err != nil {
+		return nil, nil, err
 	}
-	err = src.cache.Get(nil, parsedUrl.Path, imgSink)
-	return img, err
+	return encoded[4+headerLen:], info, nil
 }
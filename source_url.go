@@ -0,0 +1,39 @@
+package slimgfast
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// SOURCE_URL_PARAM is the query parameter that can hold the full URL of the
+// source image, for fetchers like fetchers.MultiOriginFetcher that fetch from
+// more than one origin.  Its value should be URL encoded.
+const SOURCE_URL_PARAM = "url"
+
+// SourcePath encodes the full URL of a source image as a URL path: a single
+// segment of unpadded URL-safe base64.  Requests with SOURCE_URL_PARAM are
+// rewritten to this path, so that both ways of asking for an image share a
+// cache entry.
+func SourcePath(sourceUrl string) string {
+	return "/" + base64.RawURLEncoding.EncodeToString([]byte(sourceUrl))
+}
+
+// SourceURLFromPath decodes the full URL of a source image from a path made
+// by SourcePath.  Padding is allowed, as is a file extension on the end (as
+// in "/aHR0cHM6Ly9jZG4uZXhhbXBsZS5jb20vYS5qcGc.jpg"), which is ignored.
+func SourceURLFromPath(urlPath string) (string, error) {
+	encoded := strings.TrimPrefix(urlPath, "/")
+	if i := strings.IndexByte(encoded, '.'); i != -1 {
+		encoded = encoded[:i]
+	}
+	encoded = strings.TrimRight(encoded, "=")
+	if encoded == "" || strings.Contains(encoded, "/") {
+		return "", NewError(ErrBadRequest, errors.New("The path is not an encoded source URL"))
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", NewError(ErrBadRequest, err)
+	}
+	return string(decoded), nil
+}
@@ -0,0 +1,49 @@
+package slimgfast
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestSourceURLFromPath(t *testing.T) {
+	sourceUrl := "https://cdn.partner.com/a.jpg?v=2"
+	encoded := SourcePath(sourceUrl)
+	for _, urlPath := range []string{encoded, encoded + "==", encoded + ".jpg"} {
+		decoded, err := SourceURLFromPath(urlPath)
+		if err != nil || decoded != sourceUrl {
+			t.Error("Expected", urlPath, "to decode to", sourceUrl, "got:", decoded, err)
+		}
+	}
+	for _, urlPath := range []string{"/", "/a/b", "/not*base64"} {
+		if _, err := SourceURLFromPath(urlPath); !errors.Is(err, ErrBadRequest) {
+			t.Error("Expected", urlPath, "to be a bad request, got:", err)
+		}
+	}
+}
+
+func TestImageRequestSourceURLParam(t *testing.T) {
+	sourceUrl := "https://cdn.partner.com/a.jpg?v=2"
+	req, err := ImageRequestFromURLString("/?url=" + url.QueryEscape(sourceUrl) + "&w=100")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pathReq, err := ImageRequestFromURLString(SourcePath(sourceUrl) + "?w=100")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	key, _ := req.CacheKey()
+	pathKey, _ := pathReq.CacheKey()
+	if key != pathKey || req.Width != 100 {
+		t.Error("Expected the url parameter to be moved into the path, got:", key, pathKey)
+	}
+
+	// Only requests for the root are rewritten
+	req, err = ImageRequestFromURLString("/a.jpg?url=" + url.QueryEscape(sourceUrl))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if parsedUrl, _ := url.Parse(req.Url); parsedUrl.Path != "/a.jpg" {
+		t.Error("Expected the path to be left alone, got:", req.Url)
+	}
+}
@@ -3,21 +3,124 @@ package slimgfast
 import (
 	"github.com/nfnt/resize"
 	"image"
+	"image/color"
+	"image/draw"
 )
 
 // TransformerResize is the primary Transformer that will resize images to the
 // proper size.
 type TransformerResize struct{}
 
-// Transform resizes the image as requested.
+// Transform resizes the image as requested, honoring the req.Fit attribute to
+// decide whether to clip, crop, scale, or fill the image into the requested
+// dimensions.
 func (t *TransformerResize) Transform(req *ImageRequest, image image.Image) (image.Image, error) {
-	resized := resize.Resize(
-		uint(req.Width),
-		uint(req.Height),
-		image,
-		resize.Lanczos3,
+	bounds := image.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if req.Width == 0 && req.Height == 0 {
+		return image, nil
+	}
+	// Without both dimensions there's nothing to fit the image into, so the
+	// missing dimension is derived from the aspect ratio and every fit mode
+	// but FIT_MAX boils down to a plain resize.
+	if req.Width == 0 || req.Height == 0 {
+		width, height := req.Dimensions(srcWidth, srcHeight)
+		if req.Fit == FIT_MAX && (width > srcWidth || height > srcHeight) {
+			return image, nil
+		}
+		return resize.Resize(uint(width), uint(height), image, resize.Lanczos3), nil
+	}
+	switch req.Fit {
+	case FIT_SCALE:
+		return resize.Resize(
+			uint(req.Width),
+			uint(req.Height),
+			image,
+			resize.Lanczos3,
+		), nil
+	case FIT_CROP:
+		return cropImage(image, req.Width, req.Height), nil
+	case FIT_FILL:
+		bg, err := parseHexColor(req.Background)
+		if err != nil {
+			return nil, err
+		}
+		return fillImage(image, req.Width, req.Height, bg), nil
+	case FIT_MAX:
+		if srcWidth <= req.Width && srcHeight <= req.Height {
+			return image, nil
+		}
+	}
+	// FIT_CLIP, and FIT_MAX for images that are too large.
+	width, height := fitWithin(srcWidth, srcHeight, req.Width, req.Height)
+	return resize.Resize(uint(width), uint(height), image, resize.Lanczos3), nil
+}
+
+// fitWithin returns the largest dimensions with the same aspect ratio as
+// srcWidth x srcHeight that fit within width x height.
+func fitWithin(srcWidth, srcHeight, width, height int) (int, int) {
+	if srcWidth == 0 || srcHeight == 0 {
+		return width, height
+	}
+	// Compare the aspect ratios without resorting to floating point.
+	if srcWidth*height > srcHeight*width {
+		return width, maxInt(1, roundDiv(srcHeight*width, srcWidth))
+	}
+	return maxInt(1, roundDiv(srcWidth*height, srcHeight)), height
+}
+
+// fitAround returns the smallest dimensions with the same aspect ratio as
+// srcWidth x srcHeight that completely cover width x height.
+func fitAround(srcWidth, srcHeight, width, height int) (int, int) {
+	if srcWidth == 0 || srcHeight == 0 {
+		return width, height
+	}
+	if srcWidth*height > srcHeight*width {
+		return maxInt(width, roundDiv(srcWidth*height, srcHeight)), height
+	}
+	return width, maxInt(height, roundDiv(srcHeight*width, srcWidth))
+}
+
+// cropImage scales the image so that it covers width x height, and then cuts
+// out the center of it so that it's exactly width x height.
+func cropImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	scaledWidth, scaledHeight := fitAround(bounds.Dx(), bounds.Dy(), width, height)
+	scaled := resize.Resize(uint(scaledWidth), uint(scaledHeight), img, resize.Lanczos3)
+	scaledBounds := scaled.Bounds()
+	offset := image.Pt(
+		scaledBounds.Min.X+(scaledBounds.Dx()-width)/2,
+		scaledBounds.Min.Y+(scaledBounds.Dy()-height)/2,
 	)
-	// TODO: Inspect the req.Fit attribute and either crop or scale it,
-	//       as necessary.
-	return resized, nil
+	cropped := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Bounds(), scaled, offset, draw.Src)
+	return cropped
+}
+
+// fillImage scales the image so that it fits within width x height, and then
+// centers it on a width x height canvas of the given background color.
+func fillImage(img image.Image, width, height int, bg color.Color) image.Image {
+	bounds := img.Bounds()
+	scaledWidth, scaledHeight := fitWithin(bounds.Dx(), bounds.Dy(), width, height)
+	scaled := resize.Resize(uint(scaledWidth), uint(scaledHeight), img, resize.Lanczos3)
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	target := image.Rect(0, 0, scaledWidth, scaledHeight).Add(image.Pt(
+		(width-scaledWidth)/2,
+		(height-scaledHeight)/2,
+	))
+	draw.Draw(canvas, target, scaled, scaled.Bounds().Min, draw.Over)
+	return canvas
+}
+
+// roundDiv divides a by b, rounding to the nearest integer.
+func roundDiv(a, b int) int {
+	return (a + b/2) / b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
 }
@@ -0,0 +1,82 @@
+package slimgfast
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTransformerResizeFit(t *testing.T) {
+	cases := []struct {
+		fit              string
+		srcW, srcH       int
+		reqW, reqH       int
+		expectW, expectH int
+	}{
+		// Default behaves like clip
+		{"", 400, 200, 100, 100, 100, 50},
+		{FIT_CLIP, 400, 200, 100, 100, 100, 50},
+		{FIT_CLIP, 200, 400, 100, 100, 50, 100},
+		{FIT_CLIP, 100, 50, 400, 400, 400, 200},
+		{FIT_CROP, 400, 200, 100, 100, 100, 100},
+		{FIT_CROP, 200, 400, 150, 100, 150, 100},
+		{FIT_SCALE, 400, 200, 100, 100, 100, 100},
+		{FIT_SCALE, 100, 50, 300, 400, 300, 400},
+		{FIT_MAX, 400, 200, 100, 100, 100, 50},
+		{FIT_MAX, 100, 50, 400, 400, 100, 50},
+		{FIT_MAX, 100, 50, 80, 400, 80, 40},
+		{FIT_FILL, 400, 200, 100, 100, 100, 100},
+		{FIT_FILL, 100, 50, 300, 400, 300, 400},
+		// Only one dimension requested
+		{"", 400, 200, 100, 0, 100, 50},
+		{"", 400, 200, 0, 100, 200, 100},
+		{FIT_CROP, 400, 200, 0, 100, 200, 100},
+		{FIT_MAX, 100, 50, 300, 0, 100, 50},
+		{FIT_MAX, 100, 50, 50, 0, 50, 25},
+		// No dimensions requested
+		{"", 400, 200, 0, 0, 400, 200},
+	}
+	transformer := &TransformerResize{}
+	for _, c := range cases {
+		src := image.NewRGBA(image.Rect(0, 0, c.srcW, c.srcH))
+		req := &ImageRequest{Width: c.reqW, Height: c.reqH, Fit: c.fit}
+		img, err := transformer.Transform(req, src)
+		if err != nil {
+			t.Error("Unexpected error for fit", c.fit, err.Error())
+			continue
+		}
+		bounds := img.Bounds()
+		if bounds.Dx() != c.expectW || bounds.Dy() != c.expectH {
+			t.Errorf(
+				"fit=%q %dx%d -> %dx%d: expected %dx%d, got %dx%d",
+				c.fit, c.srcW, c.srcH, c.reqW, c.reqH,
+				c.expectW, c.expectH, bounds.Dx(), bounds.Dy(),
+			)
+		}
+	}
+}
+
+func TestTransformerResizeFillBackground(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	req := &ImageRequest{Width: 100, Height: 100, Fit: FIT_FILL, Background: "f00"}
+	img, err := (&TransformerResize{}).Transform(req, src)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The top row is letterboxing, so it should be the background color.
+	r, g, b, a := img.At(50, 0).RGBA()
+	expected := color.NRGBA{R: 0xff, A: 0xff}
+	er, eg, eb, ea := expected.RGBA()
+	if r != er || g != eg || b != eb || a != ea {
+		t.Error("Expected the letterbox to be red, got:", img.At(50, 0))
+	}
+}
+
+func TestImageRequestBadFit(t *testing.T) {
+	badUrls := []string{"/a.jpg?fit=squash", "/a.jpg?fit=fill&bg=zzz"}
+	for _, rawUrl := range badUrls {
+		if _, err := ImageRequestFromURLString(rawUrl); err == nil {
+			t.Error("Expected an error parsing:", rawUrl)
+		}
+	}
+}
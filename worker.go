@@ -2,102 +2,348 @@ package slimgfast
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"image"
-	_ "image/gif"
-	"image/jpeg"
-	_ "image/png"
 	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
 )
 
 // Job is a single image resize job that can be sent over a channel to a worker.
+// The source image has already been fetched, so workers only ever spend their
+// time on image work.
 type Job struct {
-	ImageSource  ImageSource
+	Context      context.Context
+	Priority     Priority
 	ImageRequest ImageRequest
+	Data         []byte
 	Result       chan []byte
 	Error        chan error
 }
 
+// ResizedImage is a resized image, along with what the Fetcher knew about the
+// source image it was made from.
+type ResizedImage struct {
+	Data       []byte
+	SourceInfo *SourceInfo
+}
+
 // WorkerGroup is a pool of workers, a channel, and a list of Transformers
 // that this pool supports.
 type WorkerGroup struct {
 	Transformers []Transformer
 	NumWorkers   int
-	jobs         chan Job
+	// MaxWidth and MaxHeight limit the dimensions of the images this group
+	// will produce, including any dimension derived from the aspect ratio of
+	// the source image.  Zero means no limit.
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels limits the width times the height of the source images this
+	// group will decode, so that a small file that decodes to a huge image
+	// can't eat all our memory.  Zero means no limit.
+	MaxPixels int64
+	// MaxQueue is the most interactive jobs that can be waiting for a worker
+	// at once.  Once the queue is full, Resize rejects new ones with
+	// ErrOverloaded.  Zero means no limit.
+	MaxQueue int
+	// QueueTimeout is the longest an interactive job will wait for a worker
+	// before Resize gives up on it with ErrOverloaded.  Zero means no limit.
+	QueueTimeout time.Duration
+	// BackgroundShare guarantees background jobs a minimum share of the
+	// workers: when both kinds of job are waiting, a worker takes a
+	// background one after every BackgroundShare-1 interactive ones.  Zero
+	// or less means background jobs only run when no interactive jobs are
+	// waiting.
+	BackgroundShare int
+	jobs            chan Job
+	backgroundJobs  chan Job
+	// sending, if set, is called just before a job is offered to the
+	// workers, so that tests can tell when jobs are waiting on the queues.
+	sending func(priority Priority)
+	// These are updated atomically, and read through Stats.
+	live             int64
+	busy             int64
+	restarts         int64
+	queued           int64
+	backgroundQueued int64
+	rejected         int64
+}
+
+// WorkerGroupStats is a snapshot of what a WorkerGroup's workers are up to.
+type WorkerGroupStats struct {
+	// Live is the number of workers currently running.
+	Live int64
+	// Busy is the number of workers currently working on a job.
+	Busy int64
+	// Restarts is the number of times a worker has crashed and been
+	// restarted.
+	Restarts int64
+	// QueueDepth is the number of interactive jobs currently waiting for a
+	// worker, and BackgroundQueueDepth is the number of background jobs.
+	QueueDepth           int64
+	BackgroundQueueDepth int64
+	// Rejected is the number of jobs turned away because the queue was full
+	// or they waited too long.
+	Rejected int64
 }
 
 // Start spawns workers for the worker pool and starts them up.
 func (wg *WorkerGroup) Start() {
-	wg.jobs = make(chan Job, wg.NumWorkers)
+	// Jobs are handed directly to a free worker, so that everything waiting
+	// for one is counted in the queue.
+	wg.jobs = make(chan Job)
+	wg.backgroundJobs = make(chan Job)
 	for i := 0; i < wg.NumWorkers; i++ {
-		go work(wg)
+		atomic.AddInt64(&wg.live, 1)
+		go supervise(wg)
+	}
+}
+
+// Stats returns a snapshot of the worker counts.
+func (wg *WorkerGroup) Stats() WorkerGroupStats {
+	return WorkerGroupStats{
+		Live:                 atomic.LoadInt64(&wg.live),
+		Busy:                 atomic.LoadInt64(&wg.busy),
+		Restarts:             atomic.LoadInt64(&wg.restarts),
+		QueueDepth:           atomic.LoadInt64(&wg.queued),
+		BackgroundQueueDepth: atomic.LoadInt64(&wg.backgroundQueued),
+		Rejected:             atomic.LoadInt64(&wg.rejected),
 	}
 }
 
 // Close tells the workers to quit.
 func (wg *WorkerGroup) Close() {
 	close(wg.jobs)
+	close(wg.backgroundJobs)
 }
 
-// Resize enqueues one request to be run on a worker, and waits for it to
-// respond.
-func (wg *WorkerGroup) Resize(imageSource *ImageSource, imageRequest *ImageRequest) ([]byte, error) {
+// Resize enqueues the source image data for one request to be resized on a
+// worker, and waits for it to respond.  If the context is done before then,
+// Resize gives up and returns the context's error.  If the queue is full, or
+// the job waits longer than QueueTimeout for a worker, it returns
+// ErrOverloaded.  The job runs at the priority set on the context with
+// WithPriority.
+func (wg *WorkerGroup) Resize(ctx context.Context, data []byte, imageRequest *ImageRequest) ([]byte, error) {
+	// The channels are buffered so that a worker finishing a job we've given
+	// up on doesn't block forever.
 	job := Job{
-		ImageSource:  *imageSource,
+		Context:      ctx,
+		Priority:     PriorityFromContext(ctx),
 		ImageRequest: *imageRequest,
-		Result:       make(chan []byte),
-		Error:        make(chan error),
+		Data:         data,
+		Result:       make(chan []byte, 1),
+		Error:        make(chan error, 1),
 	}
-	defer close(job.Result)
-	defer close(job.Error)
 
-	wg.jobs <- job
+	if err := wg.enqueue(ctx, job); err != nil {
+		return nil, err
+	}
 
-	var resizedBytes []byte
-	var err error
 	select {
-	case resizedBytes = <-job.Result:
-	case err = <-job.Error:
+	case resized := <-job.Result:
+		return resized, nil
+	case err := <-job.Error:
+		return nil, err
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err())
 	}
-	return resizedBytes, err
 }
 
-// work consumes the job queue and sends results back on the job's result
-// channel (and errors back on the job's error channel)
-func work(wg *WorkerGroup) {
-	for job := range wg.jobs {
-		data, err := job.ImageSource.GetImageData(&job.ImageRequest)
-		if err != nil {
-			job.Error <- err
-			return
+// enqueue waits for a worker to take the job, keeping track of the queue depth
+// and turning interactive jobs away if the queue is too long.  Background jobs
+// are never turned away, they just wait their turn, unless they're promoted
+// while waiting, in which case they join the interactive queue.
+func (wg *WorkerGroup) enqueue(ctx context.Context, job Job) error {
+	if job.Priority == PRIORITY_BACKGROUND {
+		promoted, err := wg.enqueueBackground(ctx, job)
+		if !promoted {
+			return err
+		}
+		job.Priority = PRIORITY_INTERACTIVE
+	}
+
+	depth := atomic.AddInt64(&wg.queued, 1)
+	defer atomic.AddInt64(&wg.queued, -1)
+	if wg.MaxQueue > 0 && depth > int64(wg.MaxQueue) {
+		atomic.AddInt64(&wg.rejected, 1)
+		return NewError(ErrOverloaded, errors.New("The job queue is full"))
+	}
+
+	var timeout <-chan time.Time
+	if wg.QueueTimeout > 0 {
+		timer := time.NewTimer(wg.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if wg.sending != nil {
+		wg.sending(job.Priority)
+	}
+	select {
+	case wg.jobs <- job:
+		return nil
+	case <-timeout:
+		atomic.AddInt64(&wg.rejected, 1)
+		return NewError(ErrOverloaded, errors.New("Timed out waiting for a worker"))
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+}
+
+// enqueueBackground waits for a worker to take a background job.  It returns
+// true if the job was promoted to interactive priority instead.
+func (wg *WorkerGroup) enqueueBackground(ctx context.Context, job Job) (bool, error) {
+	atomic.AddInt64(&wg.backgroundQueued, 1)
+	defer atomic.AddInt64(&wg.backgroundQueued, -1)
+	if wg.sending != nil {
+		wg.sending(job.Priority)
+	}
+	select {
+	case wg.backgroundJobs <- job:
+		return false, nil
+	case <-promotionFromContext(ctx):
+		return true, nil
+	case <-ctx.Done():
+		return false, contextError(ctx.Err())
+	}
+}
+
+// supervise runs a worker, restarting it whenever it crashes, until the job
+// queue is closed.
+func supervise(wg *WorkerGroup) {
+	defer atomic.AddInt64(&wg.live, -1)
+	for !work(wg) {
+		atomic.AddInt64(&wg.restarts, 1)
+		log.Println("Restarting crashed worker")
+	}
+}
+
+// work consumes the job queues and sends results back on the job's result
+// channel (and errors back on the job's error channel).  It returns true once
+// the job queues have been closed, or false if the worker crashed.  A panic
+// while working on a job (in a Transformer or an image decoder, say) is
+// reported back as that job's error.
+func work(wg *WorkerGroup) (closed bool) {
+	var current *Job
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Worker panicked: %v\n%s", r, debug.Stack())
+			if current != nil {
+				atomic.AddInt64(&wg.busy, -1)
+				current.Error <- fmt.Errorf("Worker panicked: %v", r)
+			}
+			closed = false
 		}
-		resizedData, err := resizeImg(&job.ImageRequest, wg.Transformers, data)
-		if err == nil {
-			job.Result <- resizedData
+	}()
+	sinceBackground := 0
+	for {
+		job, ok := wg.nextJob(sinceBackground)
+		if !ok {
+			return true
+		}
+		if job.Priority == PRIORITY_BACKGROUND {
+			sinceBackground = 0
 		} else {
-			job.Error <- err
+			sinceBackground++
 		}
+		current = &job
+		atomic.AddInt64(&wg.busy, 1)
+		runJob(wg, &job)
+		atomic.AddInt64(&wg.busy, -1)
+		current = nil
+	}
+}
+
+// nextJob waits for the next job a worker should take, given how many
+// interactive jobs it has taken since its last background one.  Interactive
+// jobs come first, unless it's background work's turn under BackgroundShare.
+// It returns false once the job queues have been closed.
+func (wg *WorkerGroup) nextJob(sinceBackground int) (Job, bool) {
+	first, second := wg.jobs, wg.backgroundJobs
+	if wg.BackgroundShare > 0 && sinceBackground >= wg.BackgroundShare-1 {
+		first, second = second, first
+	}
+	select {
+	case job, ok := <-first:
+		return job, ok
+	default:
+	}
+	select {
+	case job, ok := <-second:
+		return job, ok
+	default:
+	}
+	select {
+	case job, ok := <-wg.jobs:
+		return job, ok
+	case job, ok := <-wg.backgroundJobs:
+		return job, ok
+	}
+}
+
+// runJob does the work for a single job, and sends back the result.
+func runJob(wg *WorkerGroup, job *Job) {
+	// Don't bother with jobs that nobody is waiting for anymore
+	if err := job.Context.Err(); err != nil {
+		job.Error <- contextError(err)
+		return
+	}
+	resizedData, err := wg.resizeImg(&job.ImageRequest, job.Data)
+	if err != nil {
+		job.Error <- err
+		return
 	}
+	job.Result <- resizedData
 }
 
-// resizeImg does the actual work of decoding the source image, running all the
-// transformations on it, and encoding it out as a jpeg, before returning the
-// final resized image's byte slice.
-func resizeImg(req *ImageRequest, transformers []Transformer, data []byte) ([]byte, error) {
-	// Middle variable is format name that was used
-	img, _, err := image.Decode(bytes.NewReader(data))
+// resizeImg does the actual work of decoding the source image, making sure the
+// final dimensions are within limits, running all the transformations on it,
+// and encoding it in the requested format (or the source image's format, if
+// the request didn't ask for one), before returning the final resized image's
+// byte slice.
+func (wg *WorkerGroup) resizeImg(req *ImageRequest, data []byte) ([]byte, error) {
+	if wg.MaxPixels > 0 {
+		// Check the dimensions in the header before decoding the whole image
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, NewError(ErrUnsupportedImage, err)
+		}
+		if int64(config.Width)*int64(config.Height) > wg.MaxPixels {
+			return nil, NewError(ErrTooManyPixels, fmt.Errorf(
+				"The %dx%d source image is over the limit of %d pixels",
+				config.Width, config.Height, wg.MaxPixels,
+			))
+		}
+	}
+	img, srcFormat, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		log.Println("Error decoding image", err)
-		return nil, err
+		return nil, NewError(ErrUnsupportedImage, err)
+	}
+	format := req.Format
+	if format == "" {
+		// Default to the source format, falling back to jpeg for any formats
+		// we can decode but not encode.
+		if format, err = normalizeFormat(srcFormat); err != nil {
+			format = FORMAT_JPEG
+		}
+	}
+	src := img
+	bounds := img.Bounds()
+	width, height := req.Dimensions(bounds.Dx(), bounds.Dy())
+	if wg.MaxWidth != 0 && req.Height != 0 && width > wg.MaxWidth {
+		return nil, ErrBadDimensions
 	}
-	for _, transformer := range transformers {
+	if wg.MaxHeight != 0 && req.Width != 0 && height > wg.MaxHeight {
+		return nil, ErrBadDimensions
+	}
+	for _, transformer := range wg.Transformers {
 		img, err = transformer.Transform(req, img)
 		if err != nil {
 			return nil, err
 		}
 	}
-	var buf bytes.Buffer
-	if err = jpeg.Encode(&buf, img, nil); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return encodeImage(img, src, format, req.Quality)
 }
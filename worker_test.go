@@ -0,0 +1,509 @@
+package slimgfast
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeTestPNG(t testing.TB, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestResizeImgDerivedDimensionLimits(t *testing.T) {
+	wg := &WorkerGroup{
+		Transformers: []Transformer{&TransformerResize{}},
+		MaxWidth:     500,
+		MaxHeight:    500,
+	}
+	// A tall image: asking for a width of 400 means a height of 1600.
+	data := encodeTestPNG(t, 100, 400)
+	if _, err := wg.resizeImg(&ImageRequest{Width: 400}, data); err != ErrBadDimensions {
+		t.Error("Expected ErrBadDimensions for a derived height, got:", err)
+	}
+	if _, err := wg.resizeImg(&ImageRequest{Height: 400}, data); err != nil {
+		t.Error("Expected a derived width of 100 to be fine, got:", err)
+	}
+	// A wide image: asking for a height of 300 means a width of 1200.
+	data = encodeTestPNG(t, 400, 100)
+	if _, err := wg.resizeImg(&ImageRequest{Height: 300}, data); err != ErrBadDimensions {
+		t.Error("Expected ErrBadDimensions for a derived width, got:", err)
+	}
+}
+
+func TestImageRequestSingleDimensionSize(t *testing.T) {
+	req, err := ImageRequestFromURLString("/a.jpg?w=300")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	size, err := req.Size()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if size.Key() != "300x*" {
+		t.Error("Expected a size key of 300x*, got:", size.Key())
+	}
+	req, _ = ImageRequestFromURLString("/a.jpg")
+	if _, err := req.Size(); err == nil {
+		t.Error("Expected an error getting the size of a request with no dimensions")
+	}
+}
+
+func TestResizeImgOutputFormat(t *testing.T) {
+	wg := &WorkerGroup{Transformers: []Transformer{&TransformerResize{}}}
+	data := encodeTestPNG(t, 40, 20)
+	cases := []struct {
+		format      string
+		contentType string
+	}{
+		{"", "image/png"},
+		{FORMAT_PNG, "image/png"},
+		{FORMAT_JPEG, "image/jpeg"},
+		{FORMAT_GIF, "image/gif"},
+	}
+	for _, c := range cases {
+		req := &ImageRequest{Width: 20, Height: 10, Format: c.format}
+		resized, err := wg.resizeImg(req, data)
+		if err != nil {
+			t.Error("Unexpected error for format", c.format, err.Error())
+			continue
+		}
+		if sniffed := http.DetectContentType(resized); sniffed != c.contentType {
+			t.Error("Expected", c.contentType, "for format", c.format, "got", sniffed)
+		}
+		if contentType := ContentTypeFor(req, resized); contentType != c.contentType {
+			t.Error("Expected Content-Type", c.contentType, "for format", c.format, "got", contentType)
+		}
+	}
+}
+
+func TestResizeImgKeepsGIFPalette(t *testing.T) {
+	palette := color.Palette{color.Black, color.White, color.RGBA{0xff, 0, 0, 0xff}}
+	src := image.NewPaletted(image.Rect(0, 0, 40, 40), palette)
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	wg := &WorkerGroup{Transformers: []Transformer{&TransformerResize{}}}
+	resized, err := wg.resizeImg(&ImageRequest{Width: 20, Height: 20}, buf.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	img, err := gif.Decode(bytes.NewReader(resized))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatal("Expected the resized GIF to be paletted")
+	}
+	// The encoder pads the palette out to a power of two.
+	for i, c := range palette {
+		if paletted.Palette[i] != color.RGBAModel.Convert(c) {
+			t.Error("Expected the resized GIF to keep the source palette, got:", paletted.Palette)
+			break
+		}
+	}
+}
+
+func TestResizeImgQuality(t *testing.T) {
+	wg := &WorkerGroup{Transformers: []Transformer{&TransformerResize{}}}
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			src.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8(x ^ y), 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err.Error())
+	}
+	req := &ImageRequest{Format: FORMAT_JPEG, Quality: 10}
+	low, err := wg.resizeImg(req, buf.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Quality = 95
+	high, err := wg.resizeImg(req, buf.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(low) >= len(high) {
+		t.Error("Expected q=10 to be smaller than q=95, got", len(low), "and", len(high))
+	}
+}
+
+// pngHeader returns just the signature and header chunk of a PNG, claiming
+// the given dimensions, like the start of a decompression bomb.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // RGBA
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, 0, 0, 0, 13)
+	data = append(data, ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+	return append(data, crc...)
+}
+
+func TestResizeImgMaxPixels(t *testing.T) {
+	wg := &WorkerGroup{Transformers: []Transformer{&TransformerResize{}}, MaxPixels: 10000}
+	tests := []struct {
+		data   []byte
+		status int
+	}{
+		{encodeTestPNG(t, 100, 100), http.StatusOK},
+		{encodeTestPNG(t, 200, 100), http.StatusUnprocessableEntity},
+		{pngHeader(100000, 100000), http.StatusUnprocessableEntity},
+		{[]byte("not an image"), http.StatusUnsupportedMediaType},
+	}
+	for i, test := range tests {
+		_, err := wg.resizeImg(&ImageRequest{Width: 10}, test.data)
+		status := http.StatusOK
+		if err != nil {
+			status = StatusForError(err)
+		}
+		if status != test.status {
+			t.Error("Test", i, "expected status", test.status, "got:", status, err)
+		}
+	}
+}
+
+func TestWorkerGroupResizeCancelled(t *testing.T) {
+	// A group with no workers never gets around to the job.
+	wg := &WorkerGroup{jobs: make(chan Job, 1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := wg.Resize(ctx, encodeTestPNG(t, 10, 10), &ImageRequest{Url: "/a.jpg"})
+	if StatusForError(err) != http.StatusGatewayTimeout {
+		t.Error("Expected a timeout error, got:", err)
+	}
+}
+
+// panicTransformer panics on any request with a width of 13.
+type panicTransformer struct{}
+
+func (t *panicTransformer) Transform(req *ImageRequest, img image.Image) (image.Image, error) {
+	if req.Width == 13 {
+		panic("unlucky width")
+	}
+	return img, nil
+}
+
+func TestWorkerGroupSurvivesFailingJobs(t *testing.T) {
+	wg := &WorkerGroup{NumWorkers: 2, Transformers: []Transformer{&TransformerResize{}}}
+	wg.Start()
+	defer wg.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		_, err := wg.Resize(ctx, []byte("not an image"), &ImageRequest{Width: 10})
+		if !errors.Is(err, ErrUnsupportedImage) {
+			t.Fatal("Expected ErrUnsupportedImage, got:", err)
+		}
+	}
+	if _, err := wg.Resize(ctx, encodeTestPNG(t, 20, 20), &ImageRequest{Width: 10}); err != nil {
+		t.Fatal("Expected the pool to still be working, got:", err)
+	}
+	if live := wg.Stats().Live; live != 2 {
+		t.Error("Expected 2 live workers, got:", live)
+	}
+}
+
+func TestWorkerGroupRecoversFromPanics(t *testing.T) {
+	wg := &WorkerGroup{NumWorkers: 1, Transformers: []Transformer{&panicTransformer{}}}
+	wg.Start()
+	defer wg.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := encodeTestPNG(t, 20, 20)
+	for i := 0; i < 3; i++ {
+		if _, err := wg.Resize(ctx, data, &ImageRequest{Width: 13}); err == nil {
+			t.Fatal("Expected an error from a panicking transformer")
+		}
+	}
+	if _, err := wg.Resize(ctx, data, &ImageRequest{Width: 10}); err != nil {
+		t.Fatal("Expected the pool to still be working, got:", err)
+	}
+	// The worker is only marked idle after it has sent its result
+	waitFor(t, "the worker to be idle", func() bool { return wg.Stats().Busy == 0 })
+	stats := wg.Stats()
+	if stats.Restarts != 3 {
+		t.Error("Expected 3 restarts, got:", stats.Restarts)
+	}
+	if stats.Live != 1 || stats.Busy != 0 {
+		t.Error("Expected 1 live and 0 busy workers, got:", stats)
+	}
+}
+
+// blockingTransformer holds up every job until its channel is closed.
+type blockingTransformer struct {
+	release chan struct{}
+}
+
+func (t *blockingTransformer) Transform(req *ImageRequest, img image.Image) (image.Image, error) {
+	<-t.release
+	return img, nil
+}
+
+// waitFor polls until cond is true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerGroupShedsLoad(t *testing.T) {
+	blocker := &blockingTransformer{release: make(chan struct{})}
+	wg := &WorkerGroup{
+		NumWorkers:   1,
+		Transformers: []Transformer{blocker},
+		MaxQueue:     1,
+	}
+	wg.Start()
+	defer wg.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := encodeTestPNG(t, 20, 20)
+	errs := make(chan error, 2)
+	resize := func() {
+		_, err := wg.Resize(ctx, data, &ImageRequest{Width: 10})
+		errs <- err
+	}
+	go resize()
+	// The first job only leaves the queue depth once enqueue returns, which
+	// can be after the worker has picked it up.
+	waitFor(t, "a busy worker", func() bool {
+		stats := wg.Stats()
+		return stats.Busy == 1 && stats.QueueDepth == 0
+	})
+	go resize()
+	waitFor(t, "a queued job", func() bool { return wg.Stats().QueueDepth == 1 })
+
+	// The queue is full, so this one is turned away right away.
+	_, err := wg.Resize(ctx, data, &ImageRequest{Width: 10})
+	if !errors.Is(err, ErrOverloaded) {
+		t.Error("Expected ErrOverloaded from a full queue, got:", err)
+	}
+	if status := StatusForError(err); status != http.StatusServiceUnavailable {
+		t.Error("Expected a 503 for a full queue, got:", status)
+	}
+	if rejected := wg.Stats().Rejected; rejected != 1 {
+		t.Error("Expected 1 rejected job, got:", rejected)
+	}
+
+	close(blocker.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error("Expected queued jobs to finish, got:", err)
+		}
+	}
+}
+
+func TestWorkerGroupQueueTimeout(t *testing.T) {
+	blocker := &blockingTransformer{release: make(chan struct{})}
+	wg := &WorkerGroup{
+		NumWorkers:   1,
+		Transformers: []Transformer{blocker},
+		QueueTimeout: 20 * time.Millisecond,
+	}
+	wg.Start()
+	defer wg.Close()
+	defer close(blocker.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := encodeTestPNG(t, 20, 20)
+	go wg.Resize(ctx, data, &ImageRequest{Width: 10})
+	waitFor(t, "a busy worker", func() bool { return wg.Stats().Busy == 1 })
+
+	_, err := wg.Resize(ctx, data, &ImageRequest{Width: 10})
+	if !errors.Is(err, ErrOverloaded) {
+		t.Error("Expected ErrOverloaded after waiting too long, got:", err)
+	}
+	if stats := wg.Stats(); stats.QueueDepth != 0 || stats.Rejected != 1 {
+		t.Error("Expected an empty queue and 1 rejected job, got:", stats)
+	}
+}
+
+// orderTransformer holds up jobs with a width of 1 until its channel is
+// closed, and records the widths of the jobs it sees in order.
+type orderTransformer struct {
+	release chan struct{}
+	mut     sync.Mutex
+	widths  []int
+}
+
+func (t *orderTransformer) Transform(req *ImageRequest, img image.Image) (image.Image, error) {
+	if req.Width == 1 {
+		<-t.release
+	}
+	t.mut.Lock()
+	t.widths = append(t.widths, req.Width)
+	t.mut.Unlock()
+	return img, nil
+}
+
+func TestWorkerGroupPriorities(t *testing.T) {
+	tests := []struct {
+		share int
+		first int
+	}{
+		// Interactive jobs go first...
+		{0, 2},
+		{10, 2},
+		// ...unless it's background work's turn.
+		{2, 3},
+	}
+	data := encodeTestPNG(t, 20, 20)
+	for _, test := range tests {
+		order := &orderTransformer{release: make(chan struct{})}
+		sending := make(chan Priority, 3)
+		wg := &WorkerGroup{
+			NumWorkers:      1,
+			Transformers:    []Transformer{order},
+			BackgroundShare: test.share,
+			sending:         func(priority Priority) { sending <- priority },
+		}
+		wg.Start()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		background := WithPriority(ctx, PRIORITY_BACKGROUND)
+		done := make(chan error, 3)
+		resize := func(ctx context.Context, width int) {
+			_, err := wg.Resize(ctx, data, &ImageRequest{Width: width})
+			done <- err
+		}
+		go resize(ctx, 1)
+		waitFor(t, "a busy worker", func() bool { return wg.Stats().Busy == 1 })
+		go resize(ctx, 2)
+		go resize(background, 3)
+		// Wait until the other two jobs are being offered to the worker
+		waitFor(t, "queued jobs", func() bool { return len(sending) == 3 })
+
+		close(order.release)
+		for i := 0; i < 3; i++ {
+			if err := <-done; err != nil {
+				t.Error("Expected jobs to finish, got:", err)
+			}
+		}
+		cancel()
+		wg.Close()
+		if len(order.widths) != 3 || order.widths[1] != test.first {
+			t.Errorf("With a share of %d, expected job %d to go next, got order: %v",
+				test.share, test.first, order.widths)
+		}
+	}
+}
+
+func TestPriorityFromContext(t *testing.T) {
+	ctx := context.Background()
+	if p := PriorityFromContext(ctx); p != PRIORITY_INTERACTIVE {
+		t.Error("Expected interactive priority by default, got:", p)
+	}
+	if p := PriorityFromContext(WithPriority(ctx, PRIORITY_BACKGROUND)); p != PRIORITY_BACKGROUND {
+		t.Error("Expected background priority, got:", p)
+	}
+}
+
+// fetchingTransformer fetches the source image from inside the worker, the
+// way workers used to before fetching was moved out of the pool.
+type fetchingTransformer struct {
+	src *ImageSource
+}
+
+func (t *fetchingTransformer) Transform(req *ImageRequest, img image.Image) (image.Image, error) {
+	if _, _, err := t.src.GetImageData(context.Background(), req); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+var benchmarkSlowSource *ImageSource
+var benchmarkSlowSourceOnce sync.Once
+
+// benchmarkSlowOrigin measures how quickly a worker group gets through small
+// resizes while a steady stream of requests for uncached images is stuck
+// waiting on a slow origin.
+func benchmarkSlowOrigin(b *testing.B, fetchInWorker bool) {
+	data := encodeTestPNG(b, 20, 20)
+	benchmarkSlowSourceOnce.Do(func() {
+		fetcher := &slowFetcher{delay: 20 * time.Millisecond, data: data}
+		benchmarkSlowSource = NewImageSourceCustomCache(fetcher, "slimgfast_benchmark_slow_source", 1)
+	})
+	src := benchmarkSlowSource
+	wg := &WorkerGroup{NumWorkers: 4, Transformers: []Transformer{&TransformerResize{}}}
+	if fetchInWorker {
+		wg.Transformers = append(wg.Transformers, &fetchingTransformer{src: src})
+	}
+	wg.Start()
+	defer wg.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var running sync.WaitGroup
+	var uncached int64
+	for i := 0; i < 16; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for ctx.Err() == nil {
+				req := &ImageRequest{
+					Url:   fmt.Sprintf("/uncached-%d.png", atomic.AddInt64(&uncached, 1)),
+					Width: 10,
+				}
+				if fetchInWorker {
+					wg.Resize(ctx, data, req)
+				} else if _, _, err := src.GetImageData(ctx, req); err == nil {
+					wg.Resize(ctx, data, req)
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &ImageRequest{Url: "/cached.png", Width: 10}
+		if _, err := wg.Resize(context.Background(), data, req); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.StopTimer()
+	cancel()
+	running.Wait()
+}
+
+func BenchmarkSlowOriginFetchOutsideWorkers(b *testing.B) {
+	benchmarkSlowOrigin(b, false)
+}
+
+func BenchmarkSlowOriginFetchInsideWorkers(b *testing.B) {
+	benchmarkSlowOrigin(b, true)
+}